@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+func annotate(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: git prpush annotate <commit> <branch>")
+	}
+	target, name := args[0], strings.TrimSpace(args[1])
+	if !validBranchName(name) {
+		return fmt.Errorf("invalid branch name %q", name)
+	}
+
+	status, err := gitOutput("status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(status) != "" {
+		return errors.New("the working tree has uncommitted changes, commit or stash them before annotating")
+	}
+
+	sha, err := backend.resolve(target)
+	if err != nil {
+		return err
+	}
+	head, err := backend.resolve("HEAD")
+	if err != nil {
+		return err
+	}
+	if ok, err := backend.isAncestor(sha, head); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("%s is not part of the history of HEAD", target)
+	}
+
+	message, err := backend.message(sha)
+	if err != nil {
+		return err
+	}
+	if existing := findBranchTag(message); len(existing) > 0 && !*replaceFlag {
+		return fmt.Errorf("commit %s already names branch %s, use --replace to replace it", shortSha(sha), strings.Join(existing, ", "))
+	}
+
+	file, err := ioutil.TempFile("", "git-prpush-message")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(withBranchTrailer(message, name)); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+
+	if sha == head {
+		err = runEchoed(exec.Command("git", "commit", "--amend", "--only", "--allow-empty", "--no-verify", "--cleanup=verbatim", "--file", file.Name()), out)
+		if err != nil {
+			return err
+		}
+		return printAnnotated(sha, "HEAD")
+	}
+
+	rewritten, err := commitTree(sha, file.Name())
+	if err != nil {
+		return err
+	}
+	if err := runEchoed(exec.Command("git", "rebase", "--rebase-merges", "--onto", rewritten, sha), out); err != nil {
+		return fmt.Errorf("%s, resolve it and run git rebase --continue, or git rebase --abort to undo", err)
+	}
+	return printAnnotated(sha, rewritten)
+}
+
+func withBranchTrailer(message, name string) string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(message, "\n"), "\n") {
+		if t, ok := parseTrailer(line); ok && isBranchTrailer(t.key) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	message = strings.TrimRight(strings.Join(lines, "\n"), "\n")
+
+	trailer := BRANCH_PREFIX + "=" + name
+	if len(trailers(message)) > 0 {
+		return message + "\n" + trailer + "\n"
+	}
+	return message + "\n\n" + trailer + "\n"
+}
+
+func commitTree(sha, messageFile string) (string, error) {
+	info, err := gitOutput("log", "-1", "--format=%an%x00%ae%x00%ad%x00%P", sha)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.SplitN(strings.TrimSpace(info), "\x00", 4)
+	args := []string{"commit-tree", sha + "^{tree}", "-F", messageFile}
+	for _, p := range strings.Fields(fields[3]) {
+		args = append(args, "-p", p)
+	}
+
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME="+fields[0], "GIT_AUTHOR_EMAIL="+fields[1], "GIT_AUTHOR_DATE="+fields[2])
+	stdout, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("error running commit-tree for %s err: %w", sha, err)
+	}
+	return strings.TrimSpace(string(stdout)), nil
+}
+
+func printAnnotated(old, rewritten string) error {
+	stdout, err := gitOutput("log", "--reverse", "--format=%H %s", "HEAD", "--not", rewritten+"^@")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Rewrote %s and its descendants:\n", shortSha(old))
+	for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		fmt.Fprintf(out, "  %s\n", line)
+	}
+	return nil
+}
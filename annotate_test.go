@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnnotateReplacesTrailersOnlyWithReplace(t *testing.T) {
+	r := newTestRepo(t)
+	r.commit("named\n\nPR_BRANCH=my-br")
+	r.commit("above")
+	old := r.git("rev-parse", "HEAD~1")
+	parseCommandLine(t, "HEAD~1", "other")
+
+	// --force is about overwriting remote branches and is often set in git
+	// config, so it must not let annotate replace trailers.
+	_, _, err := runCommand(t, "annotate", map[string]string{"force": "true"})
+	if err == nil || !strings.Contains(err.Error(), "use --replace") {
+		t.Errorf("annotate --force over an existing trailer err: %v, want a hint at --replace", err)
+	}
+	if got := r.git("rev-parse", "HEAD~1"); got != old {
+		t.Fatal("annotate --force rewrote HEAD~1")
+	}
+
+	if _, stderr, err := runCommand(t, "annotate", map[string]string{"force": "false", "replace": "true"}); err != nil {
+		t.Fatalf("annotate --replace err: %v\n%s", err, stderr)
+	}
+	if got := r.git("log", "-1", "--format=%B", "HEAD~1"); got != "named\n\nPR_BRANCH=other" {
+		t.Errorf("message after annotate --replace = %q", got)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+var noColorFlag = flag.Bool("no-color", false, "Never color output, which is also off when NO_COLOR is set or output is not a terminal")
+
+const (
+	colorRed    = "31"
+	colorGreen  = "32"
+	colorYellow = "33"
+	colorDim    = "2"
+)
+
+func colorEnabled(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok || *noColorFlag || *jsonFlag || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	return isTerminal(f)
+}
+
+func colorize(w io.Writer, color, s string) string {
+	if color == "" || !colorEnabled(w) {
+		return s
+	}
+	return fmt.Sprintf("\x1b[%sm%s\x1b[0m", color, s)
+}
+
+// headColor is green for a branch the remote does not have yet, yellow for
+// one whose tip moves and dim for one that is already up to date. Plans and
+// dry runs never talk to the remote, so they go by the remote-tracking refs.
+func headColor(h head) string {
+	remote := remoteHeads[h.ref]
+	if remoteHeads == nil {
+		remote, _ = backend.resolve(fmt.Sprintf("refs/remotes/%s/%s", *remoteFlag, remoteBranch(h.ref)))
+	}
+	switch remote {
+	case "":
+		return colorGreen
+	case h.sha:
+		return colorDim
+	}
+	return colorYellow
+}
+
+func colorHead(w io.Writer, h head, s string) string {
+	if !colorEnabled(w) {
+		return s
+	}
+	return colorize(w, headColor(h), s)
+}
+
+func resultColor(w io.Writer, r pushResult) string {
+	switch {
+	case !r.success:
+		return colorRed
+	case (r.action == "push" || r.action == "tag") && colorEnabled(w):
+		return headColor(r.head)
+	case r.action == "skip" || r.action == "exclude":
+		return colorDim
+	}
+	return ""
+}
+
+// printTable pads columns by hand because tabwriter would count color codes
+// towards the column width. The last column is never padded.
+func printTable(w io.Writer, rows [][]string, color func(row, col int) string) {
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			if n := utf8.RuneCountInString(cell); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+	for r, row := range rows {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			if i < len(row)-1 {
+				cell += strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell))
+			}
+			cells[i] = colorize(w, color(r, i), cell)
+		}
+		fmt.Fprintln(w, strings.TrimRight(strings.Join(cells, "  "), " "))
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+const configFileName = ".git-prpush.yml"
+const teamConfigFileName = ".prpush.toml"
+
+// repoFileKeys are the only settings a file committed to the repo may set.
+// Anything that runs commands, skips confirmation or overwrites remote state
+// has to come from the user's own git config or the command line, so that
+// cloning a repo and running git-prpush in it cannot do more than plan.
+var repoFileKeys = map[string]struct{}{
+	"base":               {},
+	"base-remote":        {},
+	"remote":             {},
+	"remote-prefix":      {},
+	"prefix":             {},
+	"trailer":            {},
+	"tag-prefix":         {},
+	"tag-template":       {},
+	"protected":          {},
+	"exclude":            {},
+	"ignore-refs":        {},
+	"no-default-ignores": {},
+	"from-change-id":     {},
+	"include-merges":     {},
+	"parent-base":        {},
+	"forge":              {},
+	"max-depth":          {},
+	"lightweight":        {},
+	"annotate":           {},
+	"mr-draft":           {},
+	"retries":            {},
+	"retry-delay":        {},
+}
+
+type setting struct {
+	value  string
+	source string
+}
+
+type config map[string][]setting
+
+func flagNames() map[string]string {
+	names := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		names[normalizeKey(f.Name)] = canonicalFlag(f.Name)
+	})
+	return names
+}
+
+func canonicalFlag(name string) string {
+	if target, ok := flagAliases[name]; ok {
+		return target
+	}
+	return name
+}
+
+func normalizeKey(key string) string {
+	key = strings.ReplaceAll(key, "-", "")
+	key = strings.ReplaceAll(key, "_", "")
+	return strings.ToLower(key)
+}
+
+func loadConfig() (config, error) {
+	cfg := make(config)
+	root := findRepoRoot()
+	if root == "" {
+		return cfg, nil
+	}
+
+	files := []struct {
+		name  string
+		parse func(line string) (string, []string, bool)
+	}{
+		{configFileName, parseYAMLLine},
+		{teamConfigFileName, parseTOMLLine},
+	}
+	names := flagNames()
+	for _, file := range files {
+		data, err := ioutil.ReadFile(filepath.Join(root, file.name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("error reading %s err: %w", file.name, err)
+		}
+
+		for i, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			key, values, ok := file.parse(line)
+			if !ok {
+				return cfg, fmt.Errorf("%s:%d: could not parse %q", file.name, i+1, line)
+			}
+			name, ok := names[normalizeKey(key)]
+			if !ok {
+				fmt.Fprintf(os.Stderr, "%s:%d: ignoring unknown key %q\n", file.name, i+1, key)
+				continue
+			}
+			if _, ok := repoFileKeys[name]; !ok {
+				fmt.Fprintf(os.Stderr, "%s:%d: ignoring %q, it can only be set in your git config or on the command line\n", file.name, i+1, key)
+				continue
+			}
+			var settings []setting
+			for _, v := range values {
+				settings = append(settings, setting{value: v, source: file.name})
+			}
+			cfg[name] = settings
+		}
+	}
+	return cfg, nil
+}
+
+func parseYAMLLine(line string) (string, []string, bool) {
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) != 2 {
+		return "", nil, false
+	}
+	return strings.TrimSpace(parts[0]), []string{unquote(parts[1])}, true
+}
+
+func parseTOMLLine(line string) (string, []string, bool) {
+	parts := strings.SplitN(line, "=", 2)
+	if len(parts) != 2 {
+		return "", nil, false
+	}
+	key := strings.TrimSpace(parts[0])
+	value := strings.TrimSpace(parts[1])
+	if !strings.HasPrefix(value, "[") {
+		return key, []string{unquote(value)}, true
+	}
+	if !strings.HasSuffix(value, "]") {
+		return "", nil, false
+	}
+	var values []string
+	for _, v := range strings.Split(strings.Trim(value, "[]"), ",") {
+		if v = unquote(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return key, values, true
+}
+
+func unquote(value string) string {
+	return strings.Trim(strings.TrimSpace(value), `"'`)
+}
+
+func findRepoRoot() string {
+	stdout, err := gitOutput("rev-parse", "--show-toplevel")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(stdout)
+}
+
+var scopeNames = map[string]string{
+	"system":   "system git config",
+	"global":   "global git config",
+	"local":    "repo git config",
+	"worktree": "worktree git config",
+	"command":  "command line git config",
+}
+
+func loadGitConfig() (config, error) {
+	names := flagNames()
+
+	entries, err := gitConfigEntries(`^prpush\.`)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := make(config)
+	for _, e := range entries {
+		name, ok := names[normalizeKey(strings.TrimPrefix(e.key, "prpush."))]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Ignoring unknown git config key %s\n", e.key)
+			continue
+		}
+		source := scopeNames[e.scope]
+		if source == "" {
+			source = e.scope + " git config"
+		}
+		settings[name] = append(settings[name], setting{value: e.value, source: source})
+	}
+	return settings, nil
+}
+
+var configSources = make(map[string]string)
+
+func applyConfig(file config) error {
+	set := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		set[canonicalFlag(f.Name)] = "command line"
+	})
+	if flag.NArg() > 0 {
+		set["base"] = "argument"
+	}
+
+	gitSettings, err := loadGitConfig()
+	if err != nil {
+		return err
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, alias := flagAliases[f.Name]; err != nil || alias {
+			return
+		}
+		if source, ok := set[f.Name]; ok {
+			configSources[f.Name] = source
+			return
+		}
+		settings := gitSettings[f.Name]
+		if len(settings) == 0 {
+			settings = file[f.Name]
+		}
+		if len(settings) == 0 {
+			configSources[f.Name] = "default"
+			return
+		}
+		for _, s := range settings {
+			if err = f.Value.Set(s.value); err != nil {
+				err = fmt.Errorf("invalid %s %q in %s err: %w", f.Name, s.value, s.source, err)
+				return
+			}
+		}
+		configSources[f.Name] = settings[len(settings)-1].source
+	})
+	if err != nil {
+		return err
+	}
+
+	// Asking for the opposite verbosity on the command line wins over config.
+	if set["verbose"] != "" && *verboseFlag && set["quiet"] == "" && *quietFlag {
+		*quietFlag = false
+		configSources["quiet"] = "overridden by command line"
+	}
+	if set["quiet"] != "" && *quietFlag && set["verbose"] == "" && *verboseFlag {
+		*verboseFlag = false
+		configSources["verbose"] = "overridden by command line"
+	}
+	return nil
+}
+
+func printConfig() error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVALUE\tSOURCE")
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, alias := flagAliases[f.Name]; alias {
+			return
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", f.Name, f.Value.String(), configSources[f.Name])
+	})
+	return w.Flush()
+}
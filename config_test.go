@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+// parseCommandLine parses args into a fresh command line sharing the real
+// flags' values, so flag.Visit only reports what args set.
+func parseCommandLine(t *testing.T, args ...string) {
+	t.Helper()
+	old := flag.CommandLine
+	fs := flag.NewFlagSet("git-prpush", flag.ContinueOnError)
+	old.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+		restore := f.Value.String()
+		t.Cleanup(func() { f.Value.Set(restore) })
+	})
+	flag.CommandLine = fs
+	t.Cleanup(func() { flag.CommandLine = old })
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyConfigPrefersTheCommandLine(t *testing.T) {
+	newTestRepo(t)
+	for _, c := range []struct {
+		name    string
+		args    []string
+		file    config
+		want    map[string]string
+		sources map[string]string
+	}{{
+		name:    "alias on the command line",
+		args:    []string{"--concurrency", "2"},
+		file:    config{"max-parallel": {{value: "4", source: "config file"}}},
+		want:    map[string]string{"max-parallel": "2"},
+		sources: map[string]string{"max-parallel": "command line"},
+	}, {
+		name:    "verbose over quiet from config",
+		args:    []string{"-v"},
+		file:    config{"quiet": {{value: "true", source: "config file"}}},
+		want:    map[string]string{"verbose": "true", "quiet": "false"},
+		sources: map[string]string{"verbose": "command line", "quiet": "overridden by command line"},
+	}, {
+		name:    "quiet over verbose from config",
+		args:    []string{"-q"},
+		file:    config{"verbose": {{value: "true", source: "config file"}}},
+		want:    map[string]string{"verbose": "false", "quiet": "true"},
+		sources: map[string]string{"verbose": "overridden by command line", "quiet": "command line"},
+	}, {
+		name:    "config without the command line",
+		file:    config{"max-parallel": {{value: "4", source: "config file"}}},
+		want:    map[string]string{"max-parallel": "4"},
+		sources: map[string]string{"max-parallel": "config file"},
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			parseCommandLine(t, c.args...)
+			if err := applyConfig(c.file); err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range c.want {
+				if got := flag.Lookup(name).Value.String(); got != want {
+					t.Errorf("%s = %s, want %s", name, got, want)
+				}
+				if got := configSources[name]; got != c.sources[name] {
+					t.Errorf("source of %s = %q, want %q", name, got, c.sources[name])
+				}
+			}
+		})
+	}
+}
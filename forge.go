@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strings"
+)
+
+type forge interface {
+	kind() string
+	openRequest(ref string) (string, error)
+	createRequest(ref, base, title, body string) (string, error)
+	requestBase(ref string) (string, error)
+	retarget(ref, base string) error
+	upsertComment(ref, marker, body string) error
+	checkAuth() error
+}
+
+func detectForge(remote string) forge {
+	switch *forgeFlag {
+	case "github":
+		return githubForge{}
+	case "gitlab":
+		return gitlabForge{}
+	}
+	url, err := gitOutput("remote", "get-url", remote)
+	if err == nil && strings.Contains(strings.ToLower(url), "gitlab") {
+		return gitlabForge{}
+	}
+	return githubForge{}
+}
+
+var repoURLs = make(map[string]string)
+
+// repoURL turns a remote's clone URL, either scp-like git@host:org/repo.git
+// or a URL with a scheme, into the https URL of its web page. It returns ""
+// for remotes that are not on a web host, such as local paths.
+func repoURL(remote string) string {
+	if u, ok := repoURLs[remote]; ok {
+		return u
+	}
+	stdout, err := gitOutput("remote", "get-url", remote)
+	if err != nil {
+		return ""
+	}
+	repoURLs[remote] = webURL(strings.TrimSpace(stdout))
+	return repoURLs[remote]
+}
+
+func webURL(raw string) string {
+	var host, repo string
+	if u, err := url.Parse(raw); err == nil && u.Scheme != "" && u.Host != "" {
+		host, repo = u.Host, u.Path
+		if u.Scheme != "http" && u.Scheme != "https" {
+			host = u.Hostname()
+		}
+	} else if i := strings.Index(raw, ":"); i > 0 && !strings.Contains(raw[:i], "/") && !strings.Contains(raw, "://") {
+		host, repo = raw[:i], raw[i+1:]
+		if j := strings.LastIndex(host, "@"); j >= 0 {
+			host = host[j+1:]
+		}
+	}
+	repo = strings.TrimSuffix(strings.Trim(repo, "/"), ".git")
+	if host == "" || repo == "" {
+		return ""
+	}
+	return fmt.Sprintf("https://%s/%s", host, repo)
+}
+
+func branchURL(remote, ref string) string {
+	base := repoURL(remote)
+	if base == "" {
+		return ""
+	}
+	if detectForge(remote).kind() == "mr" {
+		return fmt.Sprintf("%s/-/tree/%s", base, remoteBranch(ref))
+	}
+	return fmt.Sprintf("%s/tree/%s", base, remoteBranch(ref))
+}
+
+func printBranchURLs(results []pushResult) {
+	for _, r := range results {
+		if r.action != "push" || !r.success {
+			continue
+		}
+		if u := branchURL(*remoteFlag, r.head.ref); u != "" {
+			fmt.Fprintf(out, "  %s: %s\n", r.head.ref, u)
+		}
+	}
+}
+
+func requestBases(base string, tips [][]head) map[pushedKey]string {
+	bases := make(map[pushedKey]string)
+	base = baseBranchName(base)
+	for _, h := range stackHeads(base, tips) {
+		if h.base != base {
+			h.base = remoteBranch(h.base)
+		}
+		bases[pushedKey{h.sha, h.ref}] = h.base
+	}
+	return bases
+}
+
+func createRequests(f forge, base string, tips [][]head, results []pushResult) []pushResult {
+	bases := requestBases(base, tips)
+
+	var requests []pushResult
+	for _, r := range results {
+		if (r.action != "push" && r.action != "skip") || !r.success {
+			continue
+		}
+		url, err := f.openRequest(remoteBranch(r.head.ref))
+		if err == nil && url != "" {
+			requests = append(requests, pushResult{head: r.head, action: f.kind() + "-exists", success: true, message: url})
+			continue
+		}
+
+		title, err := getSubject(r.head.sha)
+		if err != nil {
+			requests = append(requests, newResult(r.head, f.kind(), err))
+			continue
+		}
+		body, err := getBody(r.head.sha)
+		if err != nil {
+			requests = append(requests, newResult(r.head, f.kind(), err))
+			continue
+		}
+		url, err = f.createRequest(remoteBranch(r.head.ref), bases[pushedKey{r.head.sha, r.head.ref}], title, body)
+		if err != nil {
+			requests = append(requests, newResult(r.head, f.kind(), err))
+			continue
+		}
+		requests = append(requests, pushResult{head: r.head, action: f.kind(), success: true, message: url})
+	}
+	return requests
+}
+
+func retargetRequests(f forge, base string, tips [][]head, results []pushResult) []pushResult {
+	bases := requestBases(base, tips)
+
+	var retargets []pushResult
+	for _, r := range results {
+		if (r.action != "push" && r.action != "skip") || !r.success {
+			continue
+		}
+		current, err := f.requestBase(remoteBranch(r.head.ref))
+		if err != nil {
+			retargets = append(retargets, newResult(r.head, "retarget", err))
+			continue
+		}
+		want := bases[pushedKey{r.head.sha, r.head.ref}]
+		if current == "" || current == want {
+			continue
+		}
+		err = f.retarget(remoteBranch(r.head.ref), want)
+		if err != nil {
+			retargets = append(retargets, newResult(r.head, "retarget", err))
+			continue
+		}
+		retargets = append(retargets, pushResult{head: r.head, action: "retarget", success: true, message: current + " -> " + want})
+	}
+	return retargets
+}
+
+const stackCommentMarker = "<!-- git-prpush stack -->"
+
+func stackComment(base string, heads []stackedHead, current head, urls map[string]string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\nThis change is part of a stack, from top to bottom:\n\n", stackCommentMarker)
+	for i, h := range heads {
+		line := remoteBranch(h.ref)
+		if url := urls[h.ref]; url != "" {
+			line = fmt.Sprintf("[%s](%s)", remoteBranch(h.ref), url)
+		}
+		if h.ref == current.ref {
+			line = fmt.Sprintf("**%s** (this one)", line)
+		}
+		fmt.Fprintf(&b, "%d. %s\n", i+1, line)
+	}
+	fmt.Fprintf(&b, "\nBased on %s.\n", base)
+	return b.String()
+}
+
+func commentRequests(f forge, base string, tips [][]head) []pushResult {
+	base = baseBranchName(base)
+	heads := stackHeads(base, tips)
+	urls := make(map[string]string)
+	for _, h := range heads {
+		if url, err := f.openRequest(remoteBranch(h.ref)); err == nil {
+			urls[h.ref] = url
+		}
+	}
+
+	var comments []pushResult
+	for _, h := range heads {
+		if urls[h.ref] == "" {
+			continue
+		}
+		err := f.upsertComment(remoteBranch(h.ref), stackCommentMarker, stackComment(base, heads, h.head, urls))
+		comments = append(comments, newResult(h.head, "comment", err))
+	}
+	return comments
+}
+
+func printStackComments(base string, tips [][]head) {
+	base = baseBranchName(base)
+	heads := stackHeads(base, tips)
+	for _, h := range heads {
+		fmt.Fprintf(out, "Stack comment for %s:\n%s\n", h.ref, stackComment(base, heads, h.head, nil))
+	}
+}
+
+func toolOutput(name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if *verboseFlag {
+		fmt.Fprintln(out, cmd)
+	}
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("error running %s err: %s", cmd, failureMessage(stderr.String(), err))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+func gitOutput(args ...string) (string, error) {
+	var b bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = &b
+	cmd.Stderr = os.Stderr
+	if *verboseFlag {
+		fmt.Fprintln(os.Stderr, cmd)
+	}
+
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func currentBranch() string {
+	return strings.TrimPrefix(symbolicRef("HEAD"), "refs/heads/")
+}
+
+// symbolicRef returns the ref name points at, or nothing when name is not a
+// symbolic ref. Without git it is read with go-git.
+func symbolicRef(name string) string {
+	if !gitInstalled() {
+		b, err := newGoGitBackend(".")
+		if err != nil {
+			return ""
+		}
+		return b.symbolicRef(name)
+	}
+	stdout, err := gitOutput("symbolic-ref", "--quiet", name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(stdout)
+}
+
+func findDefaultBranch(remote string) string {
+	if target := symbolicRef(fmt.Sprintf("refs/remotes/%s/HEAD", remote)); target != "" {
+		return strings.TrimPrefix(target, fmt.Sprintf("refs/remotes/%s/", remote))
+	}
+
+	var b bytes.Buffer
+	cmd := exec.Command("git", "remote", "show", remote)
+	cmd.Stdout = &b
+	if err := cmd.Run(); err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(b.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "HEAD branch:") {
+			branch := strings.TrimSpace(strings.TrimPrefix(line, "HEAD branch:"))
+			if branch == "(unknown)" {
+				return ""
+			}
+			return branch
+		}
+	}
+	return ""
+}
+
+type commitInfo struct {
+	parents []string
+	message string
+}
+
+type gitBackend interface {
+	resolve(ref string) (string, error)
+	loadCommits(source, target string, limit int) (map[string]commitInfo, error)
+	message(sha string) (string, error)
+	listTags(prefix string) ([]string, error)
+	isAncestor(ancestor, descendant string) (bool, error)
+	push(remote string, options, refspecs []string, w io.Writer) error
+	tag(name, sha, message string, sign bool, w io.Writer) error
+	deleteTag(name string, w io.Writer) error
+	validRef(ref string) bool
+}
+
+var backend gitBackend = newCachedBackend(execBackend{})
+
+type cachedBackend struct {
+	gitBackend
+	mu       sync.Mutex
+	shas     map[string]string
+	messages map[string]string
+}
+
+func newCachedBackend(b gitBackend) *cachedBackend {
+	return &cachedBackend{gitBackend: b, shas: make(map[string]string), messages: make(map[string]string)}
+}
+
+func (c *cachedBackend) resolve(ref string) (string, error) {
+	c.mu.Lock()
+	sha, ok := c.shas[ref]
+	c.mu.Unlock()
+	if ok {
+		return sha, nil
+	}
+	sha, err := c.gitBackend.resolve(ref)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.shas[ref] = sha
+	c.mu.Unlock()
+	return sha, nil
+}
+
+func (c *cachedBackend) loadCommits(source, target string, limit int) (map[string]commitInfo, error) {
+	commits, err := c.gitBackend.loadCommits(source, target, limit)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	for sha, info := range commits {
+		c.messages[sha] = info.message
+	}
+	c.mu.Unlock()
+	return commits, nil
+}
+
+func (c *cachedBackend) message(sha string) (string, error) {
+	c.mu.Lock()
+	message, ok := c.messages[sha]
+	c.mu.Unlock()
+	if ok {
+		return message, nil
+	}
+	message, err := c.gitBackend.message(sha)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.messages[sha] = message
+	c.mu.Unlock()
+	return message, nil
+}
+
+type execBackend struct{}
+
+func (execBackend) resolve(ref string) (string, error) {
+	var b bytes.Buffer
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	cmd.Stdout = &b
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s does not resolve to a commit", ref)
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+func (execBackend) loadCommits(source, target string, limit int) (map[string]commitInfo, error) {
+	args := []string{"log", "--format=%H %P%n%B%x00", source, "^" + target}
+	if limit > 0 {
+		args = append(args, fmt.Sprintf("--max-count=%d", limit))
+	}
+	stdout, err := gitOutput(args...)
+	if err != nil {
+		return nil, fmt.Errorf("error running load commits err: %w", err)
+	}
+
+	commits := make(map[string]commitInfo)
+	for _, record := range strings.Split(stdout, "\x00") {
+		record = strings.TrimLeft(record, "\n")
+		if record == "" {
+			continue
+		}
+		parts := strings.SplitN(record, "\n", 2)
+		fields := strings.Fields(parts[0])
+		info := commitInfo{parents: fields[1:]}
+		if len(parts) == 2 {
+			info.message = parts[1]
+		}
+		commits[fields[0]] = info
+	}
+	return commits, nil
+}
+
+func listRemoteHeads(remote string) (map[string]string, error) {
+	stdout, err := gitOutput("ls-remote", "--heads", remote)
+	if err != nil {
+		return nil, fmt.Errorf("error running list remote heads of %s err: %w", remote, err)
+	}
+
+	heads := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		ref := strings.TrimPrefix(fields[1], "refs/heads/")
+		if strings.HasPrefix(ref, *remotePrefixFlag) {
+			heads[strings.TrimPrefix(ref, *remotePrefixFlag)] = fields[0]
+		}
+	}
+	return heads, nil
+}
+
+func (execBackend) message(sha string) (string, error) {
+	stdout, err := gitOutput("show", "--no-patch", "--format=%B", sha)
+	if err != nil {
+		return "", fmt.Errorf("error running get message of %s err: %w", sha, err)
+	}
+
+	return stdout, nil
+}
+
+func (execBackend) push(remote string, options, refspecs []string, w io.Writer) error {
+	args := append([]string{"push"}, options...)
+	args = append(args, remote)
+	args = append(args, refspecs...)
+	return runEchoed(exec.Command("git", args...), w)
+}
+
+func (execBackend) tag(name, sha, message string, sign bool, w io.Writer) error {
+	if message == "" {
+		return runEchoed(exec.Command("git", "tag", "--force", name, sha), w)
+	}
+	kind := "--annotate"
+	if sign {
+		kind = "--sign"
+	}
+	return runEchoed(exec.Command("git", "tag", "--force", kind, "--message", message, name, sha), w)
+}
+
+func (execBackend) deleteTag(name string, w io.Writer) error {
+	return runEchoed(exec.Command("git", "tag", "--delete", name), w)
+}
+
+func (execBackend) isAncestor(ancestor, descendant string) (bool, error) {
+	cmd := exec.Command("git", "merge-base", "--is-ancestor", ancestor, descendant)
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error running is ancestor of %s and %s err: %w", ancestor, descendant, err)
+	}
+	return true, nil
+}
+
+func (execBackend) validRef(ref string) bool {
+	cmd := exec.Command("git", "check-ref-format", ref)
+	return cmd.Run() == nil
+}
+
+func (execBackend) listTags(prefix string) ([]string, error) {
+	pattern := "refs/tags/"
+	if prefix != "" {
+		pattern += prefix + "/"
+	}
+	stdout, err := gitOutput("for-each-ref", "--format=%(refname)", pattern)
+	if err != nil {
+		return nil, fmt.Errorf("error running list tags err: %w", err)
+	}
+
+	var tags []string
+	for _, line := range strings.Split(stdout, "\n") {
+		if line != "" {
+			tags = append(tags, strings.TrimPrefix(line, "refs/tags/"))
+		}
+	}
+	return tags, nil
+}
+
+type gitConfigEntry struct {
+	scope string
+	key   string
+	value string
+}
+
+func gitConfigEntries(pattern string) ([]gitConfigEntry, error) {
+	var b bytes.Buffer
+	cmd := exec.Command("git", "config", "--show-scope", "--get-regexp", pattern)
+	cmd.Stdout = &b
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return nil, nil
+	}
+	// Without git there is no git config to read, only the config file.
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error running git config err: %w", err)
+	}
+
+	var entries []gitConfigEntry
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		scopeAndKey := strings.SplitN(line, "\t", 2)
+		if len(scopeAndKey) != 2 {
+			continue
+		}
+		keyAndValue := strings.SplitN(scopeAndKey[1], " ", 2)
+		e := gitConfigEntry{scope: scopeAndKey[0], key: keyAndValue[0]}
+		if len(keyAndValue) == 2 {
+			e.value = keyAndValue[1]
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// managedTag reports whether tag exists and whether git-prpush made it.
+// Annotated tags carry tagMarker. Lightweight ones count when git-prpush
+// recorded creating them, or when they still point at the tip of the branch
+// their name stands for, which covers tags made before the record existed.
+func managedTag(tag string) (exists bool, managed bool, err error) {
+	stdout, err := gitOutput("for-each-ref", "--format=%(objecttype)%00%(objectname)%00%(contents)", "refs/tags/"+tag)
+	if err != nil {
+		return false, false, fmt.Errorf("error running read tag %s err: %w", tag, err)
+	}
+	if stdout == "" {
+		return false, false, nil
+	}
+
+	parts := strings.SplitN(stdout, "\x00", 3)
+	if len(parts) != 3 {
+		return true, false, nil
+	}
+	if parts[0] == "tag" {
+		return true, strings.Contains(parts[2], tagMarker), nil
+	}
+	if parts[0] != "commit" {
+		return true, false, nil
+	}
+
+	recorded, err := readTagRecord()
+	if err != nil {
+		return true, false, err
+	}
+	if recorded[tag] == parts[1] {
+		return true, true, nil
+	}
+	managed, err = tipOfBranch(tag, parts[1])
+	return true, managed, err
+}
+
+// tipOfBranch reports whether the first commit with branch trailers at or
+// below sha names the branch tag was made for.
+func tipOfBranch(tag, sha string) (bool, error) {
+	match := tagTemplateRegexp().FindStringSubmatch(tag)
+	if match == nil {
+		return false, nil
+	}
+	stdout, err := gitOutput("log", "--first-parent", "-n", "100", "--format=%P%x1f%B%x1e", sha)
+	if err != nil {
+		return false, fmt.Errorf("error running git log %s err: %w", sha, err)
+	}
+	for _, record := range strings.Split(stdout, "\x1e") {
+		fields := strings.SplitN(strings.TrimLeft(record, "\n"), "\x1f", 2)
+		if len(fields) != 2 {
+			break
+		}
+		refs := findBranchTag(fields[1])
+		for _, ref := range refs {
+			if ref == match[1] {
+				return true, nil
+			}
+		}
+		if len(refs) > 0 || strings.Contains(fields[0], " ") {
+			return false, nil
+		}
+	}
+	return false, nil
+}
+
+func gitConfigValue(key string) string {
+	stdout, err := gitOutput("config", "--get", key)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(stdout)
+}
+
+func checkSigning() error {
+	if gitConfigValue("user.signingkey") == "" {
+		return errors.New("--sign needs a signing key, set one with git config user.signingkey <key id>")
+	}
+	program := gitConfigValue("gpg.program")
+	if program == "" {
+		program = "gpg"
+	}
+	if gitConfigValue("gpg.format") == "ssh" {
+		program = gitConfigValue("gpg.ssh.program")
+		if program == "" {
+			program = "ssh-keygen"
+		}
+	}
+	if _, err := exec.LookPath(program); err != nil {
+		return fmt.Errorf("--sign needs %s to sign tags but it was not found, install it or set gpg.program", program)
+	}
+	return nil
+}
+
+func validBranchName(name string) bool {
+	return backend.validRef("refs/heads/" + name)
+}
+
+func validTagName(name string) bool {
+	return backend.validRef("refs/tags/" + name)
+}
+
+func refExists(ref string) bool {
+	_, err := backend.resolve(ref)
+	return err == nil
+}
+
+func remoteExists(remote string) bool {
+	cmd := exec.Command("git", "remote", "get-url", remote)
+	return cmd.Run() == nil
+}
+
+func getBody(sha string) (string, error) {
+	message, err := backend.message(sha)
+	if err != nil {
+		return "", err
+	}
+
+	parts := strings.SplitN(strings.TrimSpace(message), "\n\n", 2)
+	if len(parts) < 2 {
+		return "", nil
+	}
+	var lines []string
+	for _, line := range strings.Split(parts[1], "\n") {
+		if t, ok := parseTrailer(line); ok && isBranchTrailer(t.key) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n")), nil
+}
+
+func getSubject(sha string) (string, error) {
+	message, err := backend.message(sha)
+	if err != nil {
+		return "", err
+	}
+
+	paragraph := strings.SplitN(strings.TrimSpace(message), "\n\n", 2)[0]
+	return strings.Join(strings.Fields(paragraph), " "), nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// fakeBackend is an in-memory repository. Shas are derived from the names
+// commits are given, and every call and write is recorded so tests can
+// assert how often git would have been run and in which order pushes happen.
+type fakeBackend struct {
+	commits map[string]commitInfo
+	refs    map[string]string
+	tags    map[string]string
+	calls   map[string]int
+	log     []string
+
+	// pushDelay slows pushes down so that parallel ones overlap.
+	pushDelay time.Duration
+	mu        sync.Mutex
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		commits: make(map[string]commitInfo),
+		refs:    make(map[string]string),
+		tags:    make(map[string]string),
+		calls:   make(map[string]int),
+	}
+}
+
+func fakeSha(name string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(name)))
+}
+
+// commit adds a commit named name and returns its sha.
+func (f *fakeBackend) commit(name, message string, parents ...string) string {
+	sha := fakeSha(name)
+	f.commits[sha] = commitInfo{parents: parents, message: message}
+	return sha
+}
+
+// chain adds one commit per message on top of parent, oldest first, and
+// returns their shas in the same order.
+func (f *fakeBackend) chain(parent string, messages ...string) []string {
+	var shas []string
+	for _, message := range messages {
+		var parents []string
+		if parent != "" {
+			parents = []string{parent}
+		}
+		parent = f.commit(fmt.Sprintf("%s/%d/%s", parent, len(shas), message), message, parents...)
+		shas = append(shas, parent)
+	}
+	return shas
+}
+
+func (f *fakeBackend) resolve(ref string) (string, error) {
+	f.calls["resolve"]++
+	if sha, ok := f.refs[ref]; ok {
+		return sha, nil
+	}
+	if sha, ok := f.tags[ref]; ok {
+		return sha, nil
+	}
+	if _, ok := f.commits[ref]; ok {
+		return ref, nil
+	}
+	return "", fmt.Errorf("%s does not resolve to a commit", ref)
+}
+
+func (f *fakeBackend) ancestors(sha string) map[string]bool {
+	seen := make(map[string]bool)
+	stack := []string{sha}
+	for len(stack) > 0 {
+		sha := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[sha] {
+			continue
+		}
+		seen[sha] = true
+		stack = append(stack, f.commits[sha].parents...)
+	}
+	return seen
+}
+
+func (f *fakeBackend) loadCommits(source, target string, limit int) (map[string]commitInfo, error) {
+	f.calls["loadCommits"]++
+	below := f.ancestors(target)
+	commits := make(map[string]commitInfo)
+	for sha := range f.ancestors(source) {
+		if !below[sha] {
+			commits[sha] = f.commits[sha]
+		}
+	}
+	if limit > 0 && len(commits) > limit {
+		var shas []string
+		for sha := range commits {
+			shas = append(shas, sha)
+		}
+		sort.Strings(shas)
+		for _, sha := range shas[limit:] {
+			delete(commits, sha)
+		}
+	}
+	return commits, nil
+}
+
+func (f *fakeBackend) message(sha string) (string, error) {
+	f.calls["message"]++
+	info, ok := f.commits[sha]
+	if !ok {
+		return "", fmt.Errorf("error running get message of %s err: unknown commit", sha)
+	}
+	return info.message, nil
+}
+
+func (f *fakeBackend) listTags(prefix string) ([]string, error) {
+	f.calls["listTags"]++
+	var tags []string
+	for name := range f.tags {
+		if prefix == "" || strings.HasPrefix(name, prefix+"/") {
+			tags = append(tags, name)
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+func (f *fakeBackend) isAncestor(ancestor, descendant string) (bool, error) {
+	f.calls["isAncestor"]++
+	return f.ancestors(descendant)[ancestor], nil
+}
+
+func (f *fakeBackend) validRef(ref string) bool {
+	return plumbing.ReferenceName(ref).Validate() == nil
+}
+
+func (f *fakeBackend) push(remote string, options, refspecs []string, w io.Writer) error {
+	time.Sleep(f.pushDelay)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["push"]++
+	f.log = append(f.log, fmt.Sprintf("push %s %s", remote, strings.Join(refspecs, " ")))
+	return nil
+}
+
+func (f *fakeBackend) tag(name, sha, message string, sign bool, w io.Writer) error {
+	f.calls["tag"]++
+	f.tags[name] = sha
+	f.log = append(f.log, "tag "+name)
+	return nil
+}
+
+func (f *fakeBackend) deleteTag(name string, w io.Writer) error {
+	f.calls["deleteTag"]++
+	delete(f.tags, name)
+	f.log = append(f.log, "delete "+name)
+	return nil
+}
+
+func TestCachedBackendReadsEachCommitOnce(t *testing.T) {
+	f := newFakeBackend()
+	base := f.commit("base", "base")
+	stack := f.chain(base, "a1", "a2\n\nPR_BRANCH=a", "b1\n\nbody\n\nPR_BRANCH=b")
+	f.refs["main"] = base
+	useBackend(t, newCachedBackend(f))
+
+	for i := 0; i < 2; i++ {
+		paths, err := findCommitPaths(backend, stack[2], "main")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range paths[0] {
+			if _, err := getSubject(c.sha); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := getBody(c.sha); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// The base is not loaded with the stack, so it is read once and then cached.
+	for i := 0; i < 2; i++ {
+		if _, err := getSubject(base); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]int{"resolve": 1, "isAncestor": 2, "loadCommits": 2, "message": 1}
+	if !reflect.DeepEqual(f.calls, want) {
+		t.Errorf("backend calls = %v, want %v", f.calls, want)
+	}
+}
+
+// newLongStack commits n marked commits on a stack branch above main and
+// returns the tip.
+func newLongStack(b *testing.B, n int) string {
+	r := newTestRepo(b)
+	r.git("checkout", "-q", "-b", "stack")
+	for i := 0; i < n; i++ {
+		r.commit(fmt.Sprintf("commit %d\n\nPR_BRANCH=feat/%d", i, i))
+	}
+	return r.git("rev-parse", "HEAD")
+}
+
+// BenchmarkStackSubjects reads the subject of every commit in a 200-commit
+// stack the way printing a plan does, with and without the commit cache.
+func BenchmarkStackSubjects(b *testing.B) {
+	tip := newLongStack(b, 200)
+
+	for name, newBackend := range map[string]func() gitBackend{
+		"uncached": func() gitBackend { return execBackend{} },
+		"cached":   func() gitBackend { return newCachedBackend(execBackend{}) },
+	} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				useBackend(b, newBackend())
+				paths, err := findCommitPaths(backend, tip, "main")
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, c := range paths[0] {
+					if _, err := getSubject(c.sha); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkLoadCommits compares loading a 200-commit range in one git log
+// call with listing it and reading each commit on its own.
+func BenchmarkLoadCommits(b *testing.B) {
+	tip := newLongStack(b, 200)
+
+	b.Run("batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := (execBackend{}).loadCommits(tip, "main", 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("per commit", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			stdout, err := gitOutput("rev-list", "--parents", tip, "^main")
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+				if _, err := (execBackend{}).message(strings.Fields(line)[0]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type githubForge struct{}
+
+func (githubForge) kind() string {
+	return "pr"
+}
+
+func (githubForge) checkAuth() error {
+	if os.Getenv("GITHUB_TOKEN") != "" || os.Getenv("GH_TOKEN") != "" {
+		return nil
+	}
+	if _, err := toolOutput("gh", "auth", "token"); err != nil {
+		return errors.New("creating pull requests needs a GitHub token, set GITHUB_TOKEN or run gh auth login")
+	}
+	return nil
+}
+
+func (githubForge) openRequest(ref string) (string, error) {
+	return toolOutput("gh", "pr", "list", "--head", ref, "--state", "open", "--json", "url", "--jq", ".[0].url // empty")
+}
+
+func (githubForge) createRequest(ref, base, title, body string) (string, error) {
+	stdout, err := toolOutput("gh", "pr", "create", "--head", ref, "--base", base, "--title", title, "--body", body)
+	if err != nil {
+		return "", err
+	}
+	return lastLine(stdout), nil
+}
+
+func (githubForge) requestBase(ref string) (string, error) {
+	return toolOutput("gh", "pr", "list", "--head", ref, "--state", "open", "--json", "baseRefName", "--jq", ".[0].baseRefName // empty")
+}
+
+func (githubForge) retarget(ref, base string) error {
+	_, err := toolOutput("gh", "pr", "edit", ref, "--base", base)
+	return err
+}
+
+func (githubForge) upsertComment(ref, marker, body string) error {
+	number, err := toolOutput("gh", "pr", "list", "--head", ref, "--state", "open", "--json", "number", "--jq", ".[0].number")
+	if err != nil {
+		return err
+	}
+	id, err := toolOutput("gh", "api", "--paginate", fmt.Sprintf("repos/{owner}/{repo}/issues/%s/comments", number),
+		"--jq", fmt.Sprintf(".[] | select(.body | contains(%q)) | .id", marker))
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		_, err = toolOutput("gh", "pr", "comment", ref, "--body", body)
+		return err
+	}
+	_, err = toolOutput("gh", "api", "--method", "PATCH", "repos/{owner}/{repo}/issues/comments/"+strings.Fields(id)[0], "-f", "body="+body)
+	return err
+}
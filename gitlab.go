@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type gitlabForge struct{}
+
+func (gitlabForge) kind() string {
+	return "mr"
+}
+
+type gitlabMR struct {
+	IID          int    `json:"iid"`
+	State        string `json:"state"`
+	WebURL       string `json:"web_url"`
+	TargetBranch string `json:"target_branch"`
+}
+
+func openMR(ref string) (*gitlabMR, error) {
+	stdout, err := toolOutput("glab", "mr", "list", "--source-branch", ref, "--output", "json")
+	if err != nil {
+		return nil, err
+	}
+	var mrs []gitlabMR
+	if err := json.Unmarshal([]byte(stdout), &mrs); err != nil {
+		return nil, fmt.Errorf("error parsing glab output err: %w", err)
+	}
+	for i := range mrs {
+		if mrs[i].State == "opened" {
+			return &mrs[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (gitlabForge) openRequest(ref string) (string, error) {
+	mr, err := openMR(ref)
+	if mr == nil || err != nil {
+		return "", err
+	}
+	return mr.WebURL, nil
+}
+
+func (gitlabForge) requestBase(ref string) (string, error) {
+	mr, err := openMR(ref)
+	if mr == nil || err != nil {
+		return "", err
+	}
+	return mr.TargetBranch, nil
+}
+
+func (gitlabForge) retarget(ref, base string) error {
+	_, err := toolOutput("glab", "mr", "update", ref, "--target-branch", base)
+	return err
+}
+
+func (gitlabForge) checkAuth() error {
+	if os.Getenv("GITLAB_TOKEN") != "" {
+		return nil
+	}
+	if _, err := toolOutput("glab", "auth", "status"); err != nil {
+		return errors.New("creating merge requests needs a GitLab token, set GITLAB_TOKEN or run glab auth login")
+	}
+	return nil
+}
+
+func (gitlabForge) createRequest(ref, base, title, body string) (string, error) {
+	stdout, err := toolOutput("glab", "mr", "create", "--source-branch", ref, "--target-branch", base, "--title", title, "--description", body, "--yes")
+	if err != nil {
+		return "", err
+	}
+	return lastLine(stdout), nil
+}
+
+func (gitlabForge) upsertComment(ref, marker, body string) error {
+	mr, err := openMR(ref)
+	if err != nil {
+		return err
+	}
+	if mr == nil {
+		return fmt.Errorf("no open merge request for %s", ref)
+	}
+	notes := fmt.Sprintf("projects/:id/merge_requests/%d/notes", mr.IID)
+	stdout, err := toolOutput("glab", "api", "--paginate", notes)
+	if err != nil {
+		return err
+	}
+	var existing []struct {
+		ID   int    `json:"id"`
+		Body string `json:"body"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &existing); err != nil {
+		return fmt.Errorf("error parsing glab output err: %w", err)
+	}
+	for _, n := range existing {
+		if strings.Contains(n.Body, marker) {
+			_, err = toolOutput("glab", "api", "--method", "PUT", fmt.Sprintf("%s/%d", notes, n.ID), "-f", "body="+body)
+			return err
+		}
+	}
+	_, err = toolOutput("glab", "api", "--method", "POST", notes, "-f", "body="+body)
+	return err
+}
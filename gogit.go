@@ -0,0 +1,240 @@
+package main
+
+import (
+	"container/heap"
+	"flag"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+var backendFlag = flag.String("backend", "auto", "How to read the repository: exec runs git, go-git reads it in process and auto runs git unless it is not installed. Pushes and tags always run git")
+
+// goGitBackend reads commits, messages and tags with go-git. Pushing and
+// tagging still go through the git binary so credential helpers, hooks and
+// signing keep working.
+type goGitBackend struct {
+	execBackend
+	repo *git.Repository
+}
+
+func newGoGitBackend(dir string) (*goGitBackend, error) {
+	repo, err := git.PlainOpenWithOptions(dir, &git.PlainOpenOptions{DetectDotGit: true, EnableDotGitCommonDir: true})
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s with go-git err: %w", dir, err)
+	}
+	return &goGitBackend{repo: repo}, nil
+}
+
+// selectBackend picks the backend --backend asks for. go-git skips grafts,
+// replace refs and git's own history walk, so auto only uses it when there is
+// no git binary to run.
+func selectBackend(name string) (gitBackend, error) {
+	switch name {
+	case "exec":
+		return newCachedBackend(execBackend{}), nil
+	case "auto":
+		if gitInstalled() {
+			return newCachedBackend(execBackend{}), nil
+		}
+		fallthrough
+	case "go-git":
+		b, err := newGoGitBackend(".")
+		if err != nil {
+			return nil, err
+		}
+		return newCachedBackend(b), nil
+	}
+	return nil, fmt.Errorf("invalid --backend %q, it must be exec, go-git or auto", name)
+}
+
+func gitInstalled() bool {
+	_, err := exec.LookPath("git")
+	return err == nil
+}
+
+func (b *goGitBackend) resolve(ref string) (string, error) {
+	hash, err := b.repo.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		return "", fmt.Errorf("%s does not resolve to a commit", ref)
+	}
+	if _, err := b.repo.CommitObject(*hash); err != nil {
+		return "", fmt.Errorf("%s does not resolve to a commit", ref)
+	}
+	return hash.String(), nil
+}
+
+func (b *goGitBackend) message(sha string) (string, error) {
+	c, err := b.repo.CommitObject(plumbing.NewHash(sha))
+	if err != nil {
+		return "", fmt.Errorf("error running get message of %s err: %w", sha, err)
+	}
+	return c.Message, nil
+}
+
+func (b *goGitBackend) isAncestor(ancestor, descendant string) (bool, error) {
+	a, err := b.repo.CommitObject(plumbing.NewHash(ancestor))
+	if err != nil {
+		return false, fmt.Errorf("error running is ancestor of %s and %s err: %w", ancestor, descendant, err)
+	}
+	d, err := b.repo.CommitObject(plumbing.NewHash(descendant))
+	if err != nil {
+		return false, fmt.Errorf("error running is ancestor of %s and %s err: %w", ancestor, descendant, err)
+	}
+	if a.Hash == d.Hash {
+		return true, nil
+	}
+	ok, err := a.IsAncestor(d)
+	if err != nil {
+		return false, fmt.Errorf("error running is ancestor of %s and %s err: %w", ancestor, descendant, err)
+	}
+	return ok, nil
+}
+
+// validRef checks ref against git's ref format rules in process, so branch
+// and tag names can be checked without git installed.
+func (b *goGitBackend) validRef(ref string) bool {
+	return plumbing.ReferenceName(ref).Validate() == nil
+}
+
+func (b *goGitBackend) symbolicRef(name string) string {
+	ref, err := b.repo.Storer.Reference(plumbing.ReferenceName(name))
+	if err != nil || ref.Type() != plumbing.SymbolicReference {
+		return ""
+	}
+	return ref.Target().String()
+}
+
+func (b *goGitBackend) listTags(prefix string) ([]string, error) {
+	pattern := "refs/tags/"
+	if prefix != "" {
+		pattern += prefix + "/"
+	}
+	refs, err := b.repo.References()
+	if err != nil {
+		return nil, fmt.Errorf("error running list tags err: %w", err)
+	}
+
+	var tags []string
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if name := ref.Name().String(); strings.HasPrefix(name, pattern) {
+			tags = append(tags, strings.TrimPrefix(name, "refs/tags/"))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error running list tags err: %w", err)
+	}
+	return tags, nil
+}
+
+// loadCommits walks source and target together, newest first, the way
+// git log source ^target does: everything reachable from target is marked
+// uninteresting and the walk stops once only uninteresting commits older than
+// everything collected are left. A commit found to be uninteresting after it
+// was walked is walked again and dropped.
+func (b *goGitBackend) loadCommits(source, target string, limit int) (map[string]commitInfo, error) {
+	uninteresting := make(map[plumbing.Hash]bool)
+	queued := make(map[plumbing.Hash]bool)
+	walked := make(map[plumbing.Hash]bool)
+	var queue commitQueue
+	add := func(hash plumbing.Hash, bad bool) error {
+		newlyBad := bad && !uninteresting[hash]
+		if bad {
+			uninteresting[hash] = true
+		}
+		if queued[hash] || walked[hash] && !newlyBad {
+			return nil
+		}
+		c, err := b.repo.CommitObject(hash)
+		if err != nil {
+			return err
+		}
+		queued[hash] = true
+		heap.Push(&queue, c)
+		return nil
+	}
+	for _, start := range []struct {
+		ref string
+		bad bool
+	}{{source, false}, {target, true}} {
+		sha, err := b.resolve(start.ref)
+		if err != nil {
+			return nil, fmt.Errorf("error running load commits err: %w", err)
+		}
+		if err := add(plumbing.NewHash(sha), start.bad); err != nil {
+			return nil, fmt.Errorf("error running load commits err: %w", err)
+		}
+	}
+
+	shallow := make(map[plumbing.Hash]bool)
+	if hashes, err := b.repo.Storer.Shallow(); err == nil {
+		for _, h := range hashes {
+			shallow[h] = true
+		}
+	}
+
+	commits := make(map[string]commitInfo)
+	var oldest time.Time
+	for queue.Len() > 0 {
+		if queue.allUninteresting(uninteresting) && (len(commits) == 0 || queue[0].Committer.When.Before(oldest)) {
+			break
+		}
+		c := heap.Pop(&queue).(*object.Commit)
+		queued[c.Hash], walked[c.Hash] = false, true
+		bad := uninteresting[c.Hash]
+		if !bad {
+			if limit > 0 && len(commits) == limit {
+				break
+			}
+			info := commitInfo{message: c.Message}
+			for _, p := range c.ParentHashes {
+				info.parents = append(info.parents, p.String())
+			}
+			commits[c.Hash.String()] = info
+			if oldest.IsZero() || c.Committer.When.Before(oldest) {
+				oldest = c.Committer.When
+			}
+		}
+		if shallow[c.Hash] {
+			continue
+		}
+		for _, p := range c.ParentHashes {
+			if err := add(p, bad); err != nil {
+				return nil, fmt.Errorf("error running load commits err: %w", err)
+			}
+		}
+	}
+	for sha := range uninteresting {
+		delete(commits, sha.String())
+	}
+	return commits, nil
+}
+
+// commitQueue orders commits newest first by committer date.
+type commitQueue []*object.Commit
+
+func (q commitQueue) Len() int            { return len(q) }
+func (q commitQueue) Less(i, j int) bool  { return q[i].Committer.When.After(q[j].Committer.When) }
+func (q commitQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(x interface{}) { *q = append(*q, x.(*object.Commit)) }
+func (q *commitQueue) Pop() interface{} {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+func (q commitQueue) allUninteresting(uninteresting map[plumbing.Hash]bool) bool {
+	for _, c := range q {
+		if !uninteresting[c.Hash] {
+			return false
+		}
+	}
+	return true
+}
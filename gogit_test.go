@@ -0,0 +1,350 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testRepo is a throwaway repository, checked out as the working directory,
+// with a single commit on main.
+type testRepo struct {
+	t   testing.TB
+	dir string
+}
+
+func newTestRepo(t testing.TB) *testRepo {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	r := &testRepo{t: t, dir: t.TempDir()}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(r.dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	r.git("init", "-q", "-b", "main")
+	r.git("config", "user.name", "Test")
+	r.git("config", "user.email", "test@example.com")
+	r.git("config", "tag.gpgSign", "false")
+	r.commit("init")
+	return r
+}
+
+func (r *testRepo) git(args ...string) string {
+	r.t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.dir
+	cmd.Env = append(os.Environ(), "GIT_COMMITTER_DATE=2020-01-01T00:00:00Z", "GIT_AUTHOR_DATE=2020-01-01T00:00:00Z")
+	stdout, err := cmd.Output()
+	if err != nil {
+		r.t.Fatalf("git %s: %v", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(stdout))
+}
+
+func (r *testRepo) commit(message string) string {
+	r.t.Helper()
+	r.git("commit", "-q", "--allow-empty", "-m", message)
+	return r.git("rev-parse", "HEAD")
+}
+
+// stackRepo builds a stack on top of main:
+//
+//	stack: a1, a2 (PR_BRANCH=feat/a), side merged back in, b1 (PR_BRANCH=feat/b)
+type stackRepo struct {
+	*testRepo
+	init, a1, a2, side, merge, b1 string
+}
+
+func newStackRepo(t *testing.T) *stackRepo {
+	r := &stackRepo{testRepo: newTestRepo(t)}
+	r.init = r.git("rev-parse", "HEAD")
+	r.git("checkout", "-q", "-b", "stack")
+	r.a1 = r.commit("a1")
+	r.a2 = r.commit("a2\n\nPR_BRANCH=feat/a")
+	r.git("checkout", "-q", "-b", "side", r.a1)
+	r.side = r.commit("side")
+	r.git("checkout", "-q", "stack")
+	r.git("merge", "-q", "--no-ff", "-m", "merge side", "side")
+	r.merge = r.git("rev-parse", "HEAD")
+	r.b1 = r.commit("b1\n\nPR_BRANCH=feat/b")
+	r.git("tag", "-a", "-m", "annotated", "PR_BRANCH/feat/a", r.a2)
+	r.git("tag", "PR_BRANCH/feat/b", r.b1)
+	r.git("tag", "v1", r.init)
+	return r
+}
+
+func testBackends(t *testing.T) map[string]func() gitBackend {
+	return map[string]func() gitBackend{
+		"exec": func() gitBackend { return execBackend{} },
+		"go-git": func() gitBackend {
+			b, err := newGoGitBackend(".")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b
+		},
+	}
+}
+
+func TestBackendResolve(t *testing.T) {
+	for name, newBackend := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			r := newStackRepo(t)
+			b := newBackend()
+			for ref, want := range map[string]string{
+				"HEAD":             r.b1,
+				"main":             r.init,
+				"stack":            r.b1,
+				"refs/heads/side":  r.side,
+				"PR_BRANCH/feat/a": r.a2,
+				"PR_BRANCH/feat/b": r.b1,
+				"v1":               r.init,
+				r.merge:            r.merge,
+				r.a1[:10]:          r.a1,
+			} {
+				got, err := b.resolve(ref)
+				if err != nil || got != want {
+					t.Errorf("resolve(%q) = %q, %v, want %q", ref, got, err, want)
+				}
+			}
+			if got, err := b.resolve("no-such-branch"); err == nil {
+				t.Errorf("resolve(no-such-branch) = %q, want an error", got)
+			}
+		})
+	}
+}
+
+func TestBackendMessage(t *testing.T) {
+	for name, newBackend := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			r := newStackRepo(t)
+			got, err := newBackend().message(r.a2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.TrimSpace(got) != "a2\n\nPR_BRANCH=feat/a" {
+				t.Errorf("message(a2) = %q", got)
+			}
+		})
+	}
+}
+
+func TestBackendLoadCommits(t *testing.T) {
+	for name, newBackend := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			r := newStackRepo(t)
+			b := newBackend()
+
+			graph, err := b.loadCommits("stack", "main", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string][]string{
+				r.a1:    {r.init},
+				r.a2:    {r.a1},
+				r.side:  {r.a1},
+				r.merge: {r.a2, r.side},
+				r.b1:    {r.merge},
+			}
+			got := make(map[string][]string)
+			for sha, info := range graph {
+				got[sha] = info.parents
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("loadCommits(stack, main) = %v, want %v", got, want)
+			}
+			if findBranchTag(graph[r.b1].message)[0] != "feat/b" {
+				t.Errorf("message of b1 = %q", graph[r.b1].message)
+			}
+
+			graph, err = b.loadCommits("stack", "side", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var shas []string
+			for sha := range graph {
+				shas = append(shas, sha)
+			}
+			sort.Strings(shas)
+			want2 := []string{r.a2, r.merge, r.b1}
+			sort.Strings(want2)
+			if !reflect.DeepEqual(shas, want2) {
+				t.Errorf("loadCommits(stack, side) = %v, want %v", shas, want2)
+			}
+
+			if graph, err = b.loadCommits("main", "stack", 0); err != nil || len(graph) != 0 {
+				t.Errorf("loadCommits(main, stack) = %v, %v, want nothing", graph, err)
+			}
+			if graph, err = b.loadCommits("stack", "main", 2); err != nil || len(graph) != 2 {
+				t.Errorf("loadCommits(stack, main, 2) has %d commits, %v, want 2", len(graph), err)
+			}
+		})
+	}
+}
+
+func TestBackendIsAncestor(t *testing.T) {
+	for name, newBackend := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			r := newStackRepo(t)
+			b := newBackend()
+			for _, c := range []struct {
+				ancestor, descendant string
+				want                 bool
+			}{
+				{r.init, r.b1, true},
+				{r.side, r.b1, true},
+				{r.b1, r.b1, true},
+				{r.b1, r.a2, false},
+				{r.side, r.a2, false},
+			} {
+				got, err := b.isAncestor(c.ancestor, c.descendant)
+				if err != nil || got != c.want {
+					t.Errorf("isAncestor(%s, %s) = %v, %v, want %v", c.ancestor, c.descendant, got, err, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBackendListTags(t *testing.T) {
+	for name, newBackend := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			newStackRepo(t)
+			b := newBackend()
+			for prefix, want := range map[string][]string{
+				"":               {"PR_BRANCH/feat/a", "PR_BRANCH/feat/b", "v1"},
+				"PR_BRANCH":      {"PR_BRANCH/feat/a", "PR_BRANCH/feat/b"},
+				"PR_BRANCH/feat": {"PR_BRANCH/feat/a", "PR_BRANCH/feat/b"},
+				"OTHER":          nil,
+			} {
+				got, err := b.listTags(prefix)
+				sort.Strings(got)
+				if err != nil || !reflect.DeepEqual(got, want) {
+					t.Errorf("listTags(%q) = %v, %v, want %v", prefix, got, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectBackend(t *testing.T) {
+	newTestRepo(t)
+	for name, want := range map[string]interface{}{"exec": execBackend{}, "go-git": &goGitBackend{}, "auto": execBackend{}} {
+		b, err := selectBackend(name)
+		if err != nil {
+			t.Fatalf("selectBackend(%q) err: %v", name, err)
+		}
+		if got := b.(*cachedBackend).gitBackend; reflect.TypeOf(got) != reflect.TypeOf(want) {
+			t.Errorf("selectBackend(%q) = %T, want %T", name, got, want)
+		}
+	}
+	t.Setenv("PATH", t.TempDir())
+	if b, err := selectBackend("auto"); err != nil || reflect.TypeOf(b.(*cachedBackend).gitBackend) != reflect.TypeOf(&goGitBackend{}) {
+		t.Errorf("selectBackend(auto) without git = %v, %v, want go-git", b, err)
+	}
+	if _, err := selectBackend("svn"); err == nil {
+		t.Error("selectBackend(svn) succeeded, want an error")
+	}
+}
+
+func TestBackendRootCommit(t *testing.T) {
+	for name, newBackend := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			r := newTestRepo(t)
+			root := r.git("rev-parse", "HEAD")
+			r.git("checkout", "-q", "--orphan", "orphan")
+			orphan := r.commit("orphan root")
+
+			graph, err := newBackend().loadCommits("orphan", "main", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(graph) != 1 || len(graph[orphan].parents) != 0 {
+				t.Errorf("loadCommits(orphan, main) = %v, want only %s without parents", graph, orphan)
+			}
+			if _, ok := graph[root]; ok {
+				t.Errorf("loadCommits(orphan, main) includes the root of main")
+			}
+		})
+	}
+}
+
+func TestBackendListTagsEmptyAndUnusual(t *testing.T) {
+	for name, newBackend := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			r := newTestRepo(t)
+			b := newBackend()
+			for _, prefix := range []string{"", "PR_BRANCH"} {
+				if got, err := b.listTags(prefix); err != nil || len(got) != 0 {
+					t.Errorf("listTags(%q) in a repository without tags = %q, %v", prefix, got, err)
+				}
+			}
+
+			want := []string{"PR_BRANCH/feat/with.dots-and_dashes", "PR_BRANCH/feat/ünïcode"}
+			for _, tag := range want {
+				r.git("tag", tag)
+			}
+			r.git("tag", "PR_BRANCHES-old")
+			got, err := b.listTags("PR_BRANCH")
+			sort.Strings(got)
+			if err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("listTags(PR_BRANCH) = %q, %v, want %q", got, err, want)
+			}
+		})
+	}
+}
+
+func TestFindCommitPathsAtTheRoot(t *testing.T) {
+	for name, newBackend := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			r := newTestRepo(t)
+			b := newBackend()
+			root := r.git("rev-parse", "HEAD")
+
+			paths, err := findCommitPaths(b, root, "main")
+			if err != nil {
+				t.Fatalf("findCommitPaths in a single-commit repository err: %v", err)
+			}
+			for _, p := range paths {
+				if len(findTipsOfPrs(p)) != 0 {
+					t.Errorf("findCommitPaths in a single-commit repository found tips in %v", subjects(paths))
+				}
+			}
+
+			r.git("checkout", "-q", "--orphan", "orphan")
+			orphan := r.commit("orphan\n\nPR_BRANCH=feat/orphan")
+			if _, err := findCommitPaths(b, orphan, "main"); err == nil || !strings.Contains(err.Error(), "base main is not an ancestor") {
+				t.Errorf("findCommitPaths from an orphan branch err: %v, want base main is not an ancestor", err)
+			}
+		})
+	}
+}
+
+func TestPlanWithoutGit(t *testing.T) {
+	r := newStackRepo(t)
+	r.git("update-ref", "refs/remotes/origin/main", r.init)
+	r.git("symbolic-ref", "refs/remotes/origin/HEAD", "refs/remotes/origin/main")
+	t.Setenv("PATH", t.TempDir())
+
+	stdout, stderr, err := runCommand(t, "", map[string]string{"plan": "true", "backend": "auto"})
+	if err != nil {
+		t.Fatalf("plan without git err: %v\n%s", err, stderr)
+	}
+	want := r.b1 + ":refs/heads/feat/b\tb1\n" + r.a2 + ":refs/heads/feat/a\ta2\n"
+	if stdout != want {
+		t.Errorf("plan without git:\n%s\nwant:\n%s", stdout, want)
+	}
+	if strings.Contains(stderr, "detached") {
+		t.Errorf("plan without git warned about a detached HEAD:\n%s", stderr)
+	}
+}
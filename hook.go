@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const hookStart = "# >>> git-prpush >>>"
+const hookEnd = "# <<< git-prpush <<<"
+
+const hookTemplate = `%s
+case "$2" in
+merge|squash|commit) ;;
+*)
+	if ! grep -qi '^%s[=:]' "$1"; then
+		%s
+	fi
+	;;
+esac
+%s
+`
+
+// A commented line only survives -m and -F, so it is only added for the editor.
+const hookTemplateLine = `[ "$2" = message ] || printf '\n# %s=\n' >> "$1"`
+
+// The prefill is skipped on the remote's default branch and protected
+// branches, whose names cannot prefix a branch that is pushed next to them.
+const hookAutoLine = `subject=$(grep -v '^#' "$1" | head -n 1)
+		slug=$(printf '%%s' "$subject" | tr '[:upper:]' '[:lower:]' | tr -cs 'a-z0-9' '-' | sed 's/^-*//; s/-*$//' | cut -c 1-40)
+		branch=$(git symbolic-ref --quiet --short HEAD)
+		remote=%s
+		if [ "$(git symbolic-ref --quiet "refs/remotes/$remote/HEAD")" = "refs/remotes/$remote/$branch" ]; then
+			branch=
+		fi
+		case "$branch" in
+		%s) branch= ;;
+		esac
+		if [ -n "$slug" ] && [ -n "$branch" ]; then
+			printf '\n%s=%%s/%%s\n' "$branch" "$slug" >> "$1"
+		elif [ "$2" != message ]; then
+			printf '\n# %s=\n' >> "$1"
+		fi`
+
+func hookPath() (string, error) {
+	stdout, err := gitOutput("rev-parse", "--git-path", "hooks/prepare-commit-msg")
+	if err != nil {
+		return "", fmt.Errorf("error finding the hooks directory err: %w", err)
+	}
+	return strings.TrimSpace(stdout), nil
+}
+
+func hookBlock() string {
+	line := fmt.Sprintf(hookTemplateLine, BRANCH_PREFIX)
+	if *autoFlag {
+		line = fmt.Sprintf(hookAutoLine, shellQuote(*remoteFlag), hookProtectedPatterns(), BRANCH_PREFIX, BRANCH_PREFIX)
+	}
+	pattern := strings.NewReplacer("_", "[-_]", "-", "[-_]").Replace(BRANCH_PREFIX)
+	return fmt.Sprintf(hookTemplate, hookStart, pattern, line, hookEnd)
+}
+
+// hookProtectedPatterns is the protected branches as sh case patterns, with
+// everything but the glob characters quoted.
+func hookProtectedPatterns() string {
+	seen := make(map[string]bool)
+	var patterns []string
+	for _, p := range protectedPatterns(*baseFlag) {
+		if p == "" || seen[p] {
+			continue
+		}
+		seen[p] = true
+		var b strings.Builder
+		literal := ""
+		for _, r := range p {
+			if strings.ContainsRune("*?[]", r) {
+				if literal != "" {
+					b.WriteString(shellQuote(literal))
+					literal = ""
+				}
+				b.WriteRune(r)
+			} else {
+				literal += string(r)
+			}
+		}
+		if literal != "" {
+			b.WriteString(shellQuote(literal))
+		}
+		patterns = append(patterns, b.String())
+	}
+	return strings.Join(patterns, "|")
+}
+
+// withoutHookBlock returns script with the lines between the git-prpush
+// markers removed, and whether there were any.
+func withoutHookBlock(script string) (string, bool) {
+	start := strings.Index(script, hookStart)
+	end := strings.Index(script, hookEnd)
+	if start < 0 || end < start {
+		return script, false
+	}
+	return script[:start] + strings.TrimPrefix(script[end+len(hookEnd):], "\n"), true
+}
+
+// shellScript reports whether script starts with a shebang for a shell that
+// runs the sh block git-prpush adds.
+func shellScript(script string) bool {
+	line := strings.SplitN(script, "\n", 2)[0]
+	if !strings.HasPrefix(line, "#!") {
+		return false
+	}
+	fields := strings.Fields(strings.TrimPrefix(line, "#!"))
+	if len(fields) > 1 && filepath.Base(fields[0]) == "env" {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return false
+	}
+	switch filepath.Base(fields[0]) {
+	case "sh", "bash", "dash", "ash", "ksh", "zsh":
+		return true
+	}
+	return false
+}
+
+// withHookBlock adds block to script, before a final exit or exec that would
+// otherwise keep it from running.
+func withHookBlock(script, block string) string {
+	lines := strings.SplitAfter(strings.TrimRight(script, "\n")+"\n", "\n")
+	end := len(lines)
+	for i := len(lines) - 1; i > 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "exit" || line == "exec" || strings.HasPrefix(line, "exit ") || strings.HasPrefix(line, "exec ") {
+			end = i
+		}
+		break
+	}
+	return strings.Join(lines[:end], "") + block + strings.Join(lines[end:], "")
+}
+
+func installHook() error {
+	path, err := hookPath()
+	if err != nil {
+		return err
+	}
+	script := "#!/bin/sh\n"
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		rest, ours := withoutHookBlock(string(data))
+		if !ours && !*appendHookFlag {
+			return fmt.Errorf("%s already exists, use --append-hook to add git-prpush to it", path)
+		}
+		if !shellScript(rest) {
+			return fmt.Errorf("%s is not a sh script, add git-prpush to it by hand", path)
+		}
+		script = rest
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("error reading %s err: %w", path, err)
+	}
+
+	script = withHookBlock(script, hookBlock())
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error writing %s err: %w", path, err)
+	}
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		return fmt.Errorf("error writing %s err: %w", path, err)
+	}
+	fmt.Fprintf(out, "Installed prepare-commit-msg hook in %s\n", path)
+	return nil
+}
+
+func uninstallHook() error {
+	path, err := hookPath()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		fmt.Fprintln(out, "No prepare-commit-msg hook installed")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading %s err: %w", path, err)
+	}
+
+	rest, ours := withoutHookBlock(string(data))
+	if !ours {
+		fmt.Fprintf(out, "%s was not installed by git-prpush, leaving it alone\n", path)
+		return nil
+	}
+	if strings.TrimSpace(rest) == "#!/bin/sh" || strings.TrimSpace(rest) == "" {
+		err = os.Remove(path)
+	} else {
+		err = ioutil.WriteFile(path, []byte(rest), 0755)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s err: %w", path, err)
+	}
+	fmt.Fprintf(out, "Removed the git-prpush prepare-commit-msg hook from %s\n", path)
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShellScript(t *testing.T) {
+	for script, want := range map[string]bool{
+		"#!/bin/sh\nexit 0\n":            true,
+		"#!/bin/bash -e\n":               true,
+		"#!/usr/bin/env bash\n":          true,
+		"#! /bin/dash\n":                 true,
+		"#!/usr/bin/env python3\nimport": false,
+		"#!/usr/bin/perl\n":              false,
+		"echo no shebang\n":              false,
+		"":                               false,
+	} {
+		if got := shellScript(script); got != want {
+			t.Errorf("shellScript(%q) = %v, want %v", script, got, want)
+		}
+	}
+}
+
+func TestWithHookBlock(t *testing.T) {
+	for _, c := range []struct{ script, want string }{
+		{"#!/bin/sh\n", "#!/bin/sh\nBLOCK\n"},
+		{"#!/bin/sh\necho hi", "#!/bin/sh\necho hi\nBLOCK\n"},
+		{"#!/bin/sh\necho hi\nexit 0\n", "#!/bin/sh\necho hi\nBLOCK\nexit 0\n"},
+		{"#!/bin/sh\nexit\n\n# done\n", "#!/bin/sh\nBLOCK\nexit\n\n# done\n"},
+		{"#!/bin/sh\nexec other-hook \"$@\"\n", "#!/bin/sh\nBLOCK\nexec other-hook \"$@\"\n"},
+		{"#!/bin/sh\nif true; then\n\texit 1\nfi\n", "#!/bin/sh\nif true; then\n\texit 1\nfi\nBLOCK\n"},
+	} {
+		if got := withHookBlock(c.script, "BLOCK\n"); got != c.want {
+			t.Errorf("withHookBlock(%q) = %q, want %q", c.script, got, c.want)
+		}
+	}
+}
+
+func TestInstallHookIntoAnExistingHook(t *testing.T) {
+	newTestRepo(t)
+	path, err := hookPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(script string) {
+		t.Helper()
+		if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("#!/bin/sh\necho mine\nexit 0\n")
+	if _, _, err := runCommand(t, "install-hook", map[string]string{"force": "true"}); err == nil || !strings.Contains(err.Error(), "--append-hook") {
+		t.Errorf("install-hook --force over a foreign hook err: %v, want a hint at --append-hook", err)
+	}
+	if _, stderr, err := runCommand(t, "install-hook", map[string]string{"force": "false", "append-hook": "true"}); err != nil {
+		t.Fatalf("install-hook --append-hook err: %v\n%s", err, stderr)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if script := string(data); !strings.HasPrefix(script, "#!/bin/sh\necho mine\n"+hookStart) || !strings.HasSuffix(script, hookEnd+"\nexit 0\n") {
+		t.Errorf("hook after install-hook --append-hook:\n%s", script)
+	}
+
+	write("#!/usr/bin/env python3\nprint('mine')\n")
+	if _, _, err := runCommand(t, "install-hook", map[string]string{"append-hook": "true"}); err == nil || !strings.Contains(err.Error(), "not a sh script") {
+		t.Errorf("install-hook into a python hook err: %v, want a refusal", err)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "#!/usr/bin/env python3\nprint('mine')\n" {
+		t.Errorf("python hook was changed:\n%s", data)
+	}
+}
+
+func TestAutoHookSkipsDefaultAndProtectedBranches(t *testing.T) {
+	r := newTestRepo(t)
+	r.git("update-ref", "refs/remotes/origin/trunk", "HEAD")
+	r.git("symbolic-ref", "refs/remotes/origin/HEAD", "refs/remotes/origin/trunk")
+	old := protectedFlag
+	protectedFlag = stringsFlag{"stable/*"}
+	t.Cleanup(func() { protectedFlag = old })
+	if _, stderr, err := runCommand(t, "install-hook", map[string]string{"auto": "true"}); err != nil {
+		t.Fatalf("install-hook --auto err: %v\n%s", err, stderr)
+	}
+
+	for branch, want := range map[string]string{
+		"trunk":     "Fix the thing",
+		"main":      "Fix the thing",
+		"release/1": "Fix the thing",
+		"stable/2":  "Fix the thing",
+		"topic":     "Fix the thing\n\nPR_BRANCH=topic/fix-the-thing",
+	} {
+		r.git("checkout", "-q", "-B", branch)
+		r.commit("Fix the thing")
+		if got := r.git("log", "-1", "--format=%B"); got != want {
+			t.Errorf("message on %s = %q, want %q", branch, got, want)
+		}
+	}
+}
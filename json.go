@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const jsonVersion = 1
+
+type jsonReport struct {
+	Version  int          `json:"version"`
+	Base     string       `json:"base"`
+	Branches []jsonBranch `json:"branches"`
+}
+
+type jsonBranch struct {
+	Ref     string       `json:"ref"`
+	Sha     string       `json:"sha"`
+	Subject string       `json:"subject"`
+	Base    string       `json:"base"`
+	Commits []string     `json:"commits"`
+	URL     string       `json:"url,omitempty"`
+	Result  *jsonResult  `json:"result,omitempty"`
+	Actions []jsonResult `json:"actions,omitempty"`
+}
+
+type jsonResult struct {
+	Action  string `json:"action"`
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+}
+
+func printJSON(base string, tips [][]head, results []pushResult) error {
+	report := jsonReport{Version: jsonVersion, Base: base, Branches: []jsonBranch{}}
+	for _, h := range stackHeads(base, tips) {
+		subject, err := getSubject(h.sha)
+		if err != nil {
+			return err
+		}
+		b := jsonBranch{
+			Ref:     h.ref,
+			Sha:     h.sha,
+			Subject: subject,
+			Base:    h.base,
+			Commits: h.commits,
+		}
+		for _, r := range results {
+			if r.head.sha != h.sha || r.head.ref != h.ref {
+				continue
+			}
+			result := jsonResult{Action: r.action, Success: r.success, Message: r.message}
+			switch r.action {
+			case "push", "tag", "skip", "exclude":
+				b.Result = &result
+			default:
+				b.Actions = append(b.Actions, result)
+			}
+			if r.action == "push" && r.success {
+				b.URL = branchURL(*remoteFlag, h.ref)
+			}
+		}
+		report.Branches = append(report.Branches, b)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return fmt.Errorf("error writing json err: %w", err)
+	}
+	return nil
+}
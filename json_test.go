@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPrintJSONKeepsThePushResult(t *testing.T) {
+	r := newTestRepo(t)
+	r.git("remote", "add", "origin", "https://github.com/acme/widgets.git")
+	oldURLs := repoURLs
+	repoURLs = make(map[string]string)
+	t.Cleanup(func() { repoURLs = oldURLs })
+	f := newFakeBackend()
+	base := f.commit("base", "base")
+	stack := f.chain(base, "a\n\nPR_BRANCH=feat/a")
+	useBackend(t, f)
+	h := head{sha: stack[0], ref: "feat/a"}
+	results := []pushResult{
+		newResult(h, "push", nil),
+		newResult(h, "hook", errors.New("exit status 1")),
+		newResult(h, "create", nil),
+	}
+
+	stdout, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Stdout
+	os.Stdout = stdout
+	err = printJSON("main", [][]head{{h}}, results)
+	os.Stdout = old
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, _ := ioutil.ReadFile(stdout.Name())
+
+	var report jsonReport
+	if err := json.Unmarshal(o, &report); err != nil {
+		t.Fatalf("invalid json %s err: %v", o, err)
+	}
+	if len(report.Branches) != 1 {
+		t.Fatalf("branches = %+v, want feat/a only", report.Branches)
+	}
+	b := report.Branches[0]
+	if want := "https://github.com/acme/widgets/tree/feat/a"; b.URL != want {
+		t.Errorf("url = %q, want %q", b.URL, want)
+	}
+	if want := (&jsonResult{Action: "push", Success: true}); !reflect.DeepEqual(b.Result, want) {
+		t.Errorf("result = %+v, want %+v", b.Result, want)
+	}
+	want := []jsonResult{{Action: "hook", Message: "exit status 1"}, {Action: "create", Success: true}}
+	if !reflect.DeepEqual(b.Actions, want) {
+		t.Errorf("actions = %+v, want %+v", b.Actions, want)
+	}
+}
+
+// The JSON describes the whole stack, so a branch left out by --only still
+// shows up as the base of the branch above it.
+func TestOnlyKeepsTheBaseBelowInJSON(t *testing.T) {
+	r := newTestRepo(t)
+	r.git("checkout", "-q", "-b", "stack")
+	r.commit("a\n\nPR_BRANCH=feat/a")
+	r.commit("b\n\nPR_BRANCH=feat/b")
+
+	old := onlyFlag
+	onlyFlag = stringsFlag{"feat/b"}
+	t.Cleanup(func() { onlyFlag = old })
+	stdout, stderr, err := runCommand(t, "", map[string]string{"base": "main", "plan": "true", "json": "true"})
+	if err != nil {
+		t.Fatalf("plan err: %v\n%s", err, stderr)
+	}
+
+	var report jsonReport
+	if err := json.Unmarshal([]byte(stdout), &report); err != nil {
+		t.Fatalf("invalid json %s err: %v", stdout, err)
+	}
+	bases := make(map[string]string)
+	for _, b := range report.Branches {
+		bases[b.Ref] = b.Base
+	}
+	if want := map[string]string{"feat/a": "main", "feat/b": "feat/a"}; !reflect.DeepEqual(bases, want) {
+		t.Errorf("bases = %v, want %v", bases, want)
+	}
+}
@@ -1,160 +1,1382 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
+	"path"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 var dryRunFlag = flag.Bool("dry", false, "Tags commits that will be uploaded in a non-dry run")
+var dryDeleteFlag = flag.Bool("dry-delete", false, "Prints stale tags that would be deleted instead of deleting them")
+var forceTagsFlag = flag.Bool("force-tags", false, "Overwrite and delete tags in the tag namespace that were not created by git-prpush")
+var skipInvalidFlag = flag.Bool("skip-invalid", false, "Warn about and skip branch names git would reject instead of aborting")
+var baseFlag = flag.String("base", "", "Branch, remote-tracking ref, tag or commit the stack is based on (default the remote's HEAD branch)")
+var baseRemoteFlag = flag.String("base-remote", "", "Resolve the base against this remote's tracking branch, e.g. origin/main instead of main")
+var remoteFlag = flag.String("remote", "origin", "Remote that branches are pushed to")
+var ignoreRefsFlag = flag.String("ignore-refs", "", "Comma-separated trailer values, matched ignoring case, that mark a commit as belonging to no branch")
+var noDefaultIgnoresFlag = flag.Bool("no-default-ignores", false, "Treat null and nil as branch names instead of ignoring them")
+var remotePrefixFlag = flag.String("remote-prefix", "", "Prepended to every branch name on the remote, e.g. users/alice/, while tags keep the trailer's name")
+var forceFlag = flag.Bool("force", false, "Overwrite remote branches even if they moved since they were last seen")
+var prefixFlag = flag.String("prefix", BRANCH_PREFIX, "Default for both --trailer and --tag-prefix")
+var trailerFlag = flag.String("trailer", "", "Commit message trailer naming a PR branch, matched ignoring case and -/_ so PR-Branch: also works; every spelling found is used (default --prefix)")
+var tagPrefixFlag = flag.String("tag-prefix", "", "Namespace for dry-run tags (default --prefix)")
+var tagTemplateFlag = flag.String("tag-template", "", "Name dry-run tags with a template using {ref} and {sha} (default <tag-prefix>/{ref})")
+var showConfigFlag = flag.Bool("show-config", false, "Prints the effective settings and where each came from")
+var yesFlag = flag.Bool("yes", false, "Push without asking for confirmation")
+var planFlag = flag.Bool("plan", false, "Prints the refspecs that would be pushed without tagging or pushing")
+var maxParallelFlag = flag.Int("max-parallel", 1, "Maximum number of branches pushed at the same time")
+var atomicFlag = flag.Bool("atomic", false, "Push all branches with a single atomic git push")
+var forceAllFlag = flag.Bool("force-all", false, "Push branches even if the remote already points at the same commit")
+var shaFlag = flag.Bool("sha", false, "Include tip shas when listing branches")
+var verboseFlag = flag.Bool("verbose", false, "Echo every git and forge command and its output, and include stack bases when listing branches")
+var quietFlag = flag.Bool("quiet", false, "Only print errors and the final summary instead of a line per branch")
+var jsonFlag = flag.Bool("json", false, "Prints the stack and its results as JSON, sending human output to stderr")
+var createPRsFlag = flag.Bool("create-prs", false, "Open a pull request for each pushed branch, based on the branch below it in the stack, with gh or glab depending on the remote's host")
+var headFlag = flag.String("head", "HEAD", "Commit or branch at the top of the stack")
+var retriesFlag = flag.Int("retries", 0, "Retry a push this many times when it fails with a network error")
+var retryDelayFlag = flag.Duration("retry-delay", 2*time.Second, "Wait this long before the first retry, doubling after each attempt")
+var maxDepthFlag = flag.Int("max-depth", 0, "Give up if the base is more than this many commits below the stack tip (default unlimited)")
+var pruneRemoteFlag = flag.Bool("prune-remote", false, "Delete remote branches git-prpush pushed earlier that are no longer in the stack")
+var lightweightFlag = flag.Bool("lightweight", false, "Create lightweight dry-run tags instead of annotated tags that record the run")
+var signFlag = flag.Bool("sign", false, "GPG-sign dry-run tags with git tag -s")
+var noSignFlag = flag.Bool("no-sign", false, "Do not sign dry-run tags, overriding --sign from config")
+var annotateFlag = flag.Bool("annotate", false, "Create annotated dry-run tags, overriding --lightweight from config")
+var excludeFlag stringsFlag
+var onlyFlag stringsFlag
+var forgeFlag = flag.String("forge", "", "Code host of the remote, github or gitlab (default detected from the remote URL); gitlab also opens merge requests with push options")
+var mrDraftFlag = flag.Bool("mr-draft", false, "Mark merge requests opened with --forge=gitlab push options as drafts")
+var fromChangeIDFlag = flag.Bool("from-change-id", false, "Name branches changes/<Change-Id prefix> for commits with a Gerrit Change-Id trailer but no branch trailer")
+var printStackFlag = flag.Bool("print-stack", false, "Prints the detected stack as a tree above its base without pushing or tagging")
+var deleteAllTagsFlag = flag.Bool("delete-all-tags", false, "Delete every dry-run tag in the tag namespace, previewing with --dry")
+var replaceFlag = flag.Bool("replace", false, "With annotate, replace the branch trailer a commit already has")
+var appendHookFlag = flag.Bool("append-hook", false, "With install-hook, add git-prpush to an existing prepare-commit-msg shell script it did not install")
+var autoFlag = flag.Bool("auto", false, "With install-hook, prefill the branch trailer from the current branch and the commit subject")
+var includeMergesFlag = flag.Bool("include-merges", false, "Push segments that end at a merge commit with a branch trailer instead of only using the merge as a boundary")
+var autoNameFlag = flag.Bool("auto-name", false, "Push segments without a branch trailer as <user>/<subject>-<sha> instead of skipping them")
+var stackCommentFlag = flag.Bool("stack-comment", false, "Keep a comment listing the whole stack on each open pull request, printing it instead under --dry and --plan")
+var retargetFlag = flag.Bool("retarget", false, "Point the base of each open pull request at the branch now below it in the stack")
+var parentBaseFlag = flag.Bool("parent-base", false, "Base every pull request on the base branch instead of stacking it on the branch below")
+var createMRsFlag = flag.Bool("create-mrs", false, "Like --create-prs but always opens GitLab merge requests with glab")
+var onPushFlag = flag.String("on-push", "", "Shell command run after each branch is pushed, {ref} and {sha} are replaced with the branch and its tip")
+
+// flagAliases maps each alias to the flag it stands for, so configuration
+// treats both names as one setting.
+var flagAliases = map[string]string{"concurrency": "max-parallel", "v": "verbose", "q": "quiet"}
+
+func init() {
+	flag.IntVar(maxParallelFlag, "concurrency", 1, "Alias for --max-parallel")
+	flag.BoolVar(verboseFlag, "v", false, "Alias for --verbose")
+	flag.BoolVar(quietFlag, "q", false, "Alias for --quiet")
+	flag.Var(&excludeFlag, "exclude", "Skip branches whose name matches one of these comma-separated globs, can be repeated")
+	flag.Var(&onlyFlag, "only", "Only act on branches whose name matches one of these comma-separated globs, can be repeated")
+}
+
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if _, err := path.Match(v, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q err: %w", v, err)
+		}
+		*f = append(*f, v)
+	}
+	return nil
+}
+
+var version = "dev"
+
+// out carries progress and diagnostics, leaving stdout free for the plan,
+// listings and JSON.
+var out io.Writer = os.Stderr
+
+var subcommands = map[string]struct{}{
+	"status":         {},
+	"list":           {},
+	"annotate":       {},
+	"install-hook":   {},
+	"uninstall-hook": {},
+}
 
 func main() {
-	flag.Parse()
-	paths := findCommitPaths("main")
-  var active []string
+	args := os.Args[1:]
+	command := ""
+	if len(args) > 0 {
+		if _, ok := subcommands[args[0]]; ok {
+			command, args = args[0], args[1:]
+		}
+	}
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(args); err == flag.ErrHelp {
+		os.Exit(exitOK)
+	} else if err != nil {
+		os.Exit(exitError)
+	}
+	if err := run(command); err != nil {
+		code := exitError
+		var e exitCodeError
+		if errors.As(err, &e) {
+			code = e.code
+		}
+		log.Print(err)
+		os.Exit(code)
+	}
+}
+
+// Exit codes that scripts can rely on. Usage, configuration and git errors
+// all exit with exitError.
+const (
+	exitOK         = 0
+	exitError      = 1
+	exitPushFailed = 2
+	exitNoBranches = 3
+)
+
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+func (e exitCodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e exitCodeError) Unwrap() error {
+	return e.err
+}
+
+func noBranchesError(base string) error {
+	return exitCodeError{exitNoBranches, fmt.Errorf("no commits above %s have a %s trailer", base, BRANCH_PREFIX)}
+}
+
+func run(command string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if err := applyConfig(cfg); err != nil {
+		return err
+	}
+	for _, name := range []string{"trailer", "tag-prefix"} {
+		if flag.Lookup(name).Value.String() == "" {
+			flag.Set(name, *prefixFlag)
+			configSources[name] = "prefix"
+		}
+	}
+	BRANCH_PREFIX = *trailerFlag
+	TAG_PREFIX = *tagPrefixFlag
+	for name, value := range map[string]string{"trailer": BRANCH_PREFIX, "tag prefix": TAG_PREFIX} {
+		if value == "" || strings.ContainsAny(value, " \t\r\n") {
+			return fmt.Errorf("invalid %s %q, it must be non-empty and contain no whitespace", name, value)
+		}
+	}
+	if *tagTemplateFlag == "" {
+		*tagTemplateFlag = TAG_PREFIX + "/{ref}"
+	}
+	if *showConfigFlag {
+		return printConfig()
+	}
+	if backend, err = selectBackend(*backendFlag); err != nil {
+		return err
+	}
+	if err := validateTagTemplate(*tagTemplateFlag); err != nil {
+		return err
+	}
+	if *remotePrefixFlag != "" && !validBranchName(*remotePrefixFlag+"branch") {
+		return fmt.Errorf("invalid --remote-prefix %q, it does not form valid branch names", *remotePrefixFlag)
+	}
+	if *retriesFlag < 0 || *retryDelayFlag < 0 {
+		return errors.New("--retries and --retry-delay cannot be negative")
+	}
+	if *quietFlag && *verboseFlag {
+		return errors.New("--quiet and --verbose cannot be used together")
+	}
+	if *noSignFlag {
+		*signFlag = false
+	}
+	if *annotateFlag {
+		*lightweightFlag = false
+	}
+	if *signFlag && *lightweightFlag {
+		return errors.New("--sign and --lightweight cannot be used together, lightweight tags cannot be signed")
+	}
+	if *signFlag && *dryRunFlag {
+		if err := checkSigning(); err != nil {
+			return err
+		}
+	}
+	switch *forgeFlag {
+	case "", "github", "gitlab":
+	default:
+		return fmt.Errorf("invalid --forge %q, it must be github or gitlab", *forgeFlag)
+	}
+	if *forgeFlag == "gitlab" && *atomicFlag {
+		return errors.New("--forge=gitlab and --atomic cannot be used together, merge request push options apply to a whole push")
+	}
+	if *maxDepthFlag < 0 {
+		return fmt.Errorf("invalid --max-depth %d, it must not be negative", *maxDepthFlag)
+	}
+	if *maxParallelFlag < 1 {
+		return fmt.Errorf("invalid --max-parallel/--concurrency %d, it must be at least 1", *maxParallelFlag)
+	}
+
+	switch command {
+	case "annotate":
+		return annotate(flag.Args())
+	case "install-hook":
+		return installHook()
+	case "uninstall-hook":
+		return uninstallHook()
+	}
+	if *deleteAllTagsFlag {
+		results, err := removeStaleTags(nil, *dryRunFlag || *dryDeleteFlag)
+		if err != nil {
+			return err
+		}
+		return printSummary(results)
+	}
+
+	if !*dryRunFlag && !*planFlag && !*printStackFlag && command != "list" && !remoteExists(*remoteFlag) {
+		return fmt.Errorf("remote %q does not exist, pass an existing remote with --remote", *remoteFlag)
+	}
+	base, err := findBase()
+	if err != nil {
+		return err
+	}
+	tip, err := backend.resolve(*headFlag)
+	if err != nil {
+		return err
+	}
+	if !*quietFlag {
+		subject, err := getSubject(tip)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Stack tip %s is %s %s\n", *headFlag, shortSha(tip), subject)
+	}
+	detached := *headFlag == "HEAD" && currentBranch() == ""
+	if detached {
+		fmt.Fprintln(os.Stderr, "Warning: HEAD is detached, using the stack below the checked out commit")
+	}
+	paths, err := findCommitPaths(backend, tip, base)
+	if err != nil {
+		return err
+	}
+	var tips [][]head
 	for _, p := range paths {
-		t := findTipsOfPrs(p)
-		if *dryRunFlag {
-			active = append(active, tagBranches(t)...)
+		tips = append(tips, findTipsOfPrs(p))
+	}
+	if *verboseFlag {
+		for _, t := range tips {
+			for _, h := range t {
+				if shouldIgnoreRef(h.ref) {
+					fmt.Fprintf(os.Stderr, "Ignoring %s=%s on %s, it is in the ignored refs\n", BRANCH_PREFIX, h.ref, shortSha(h.marker))
+				}
+			}
+		}
+	}
+	tips, err = validateBranchNames(paths, tips)
+	if err != nil {
+		return err
+	}
+	warnDuplicateTips(tips)
+	if err := checkSelfReferences(base, tip, tips); err != nil {
+		return err
+	}
+	if command == "" && !*printStackFlag {
+		if err := checkProtected(base, tips, !*dryRunFlag && !*planFlag); err != nil {
+			return err
+		}
+	}
+	for _, h := range plannedHeads(tips) {
+		if h.auto && !*quietFlag {
+			fmt.Fprintf(os.Stderr, "Auto-named %s as %s, keep the name with: git prpush annotate %s %s\n", shortSha(h.sha), h.ref, shortSha(h.marker), h.ref)
+		}
+	}
+	allTips := tips
+	var active []string
+	for _, h := range plannedHeads(tips) {
+		active = append(active, tagName(h))
+	}
+	tips, excluded := excludeHeads(tips)
+	if missing := unmatchedPatterns(excludeFlag, plannedHeads(allTips)); len(missing) > 0 && !*quietFlag {
+		fmt.Fprintf(os.Stderr, "Warning: --exclude %s matched no branch in the stack\n", strings.Join(missing, ","))
+	}
+	if len(onlyFlag) > 0 {
+		if missing := unmatchedPatterns(onlyFlag, plannedHeads(allTips)); len(missing) > 0 {
+			return fmt.Errorf("--only %s matched no branch in the stack", strings.Join(missing, ","))
+		}
+		tips = onlyHeads(tips)
+	}
+
+	switch command {
+	case "status":
+		return printStatus(tips)
+	case "list":
+		printList(base, tips)
+		return nil
+	}
+	if *printStackFlag {
+		return printStack(base, tips)
+	}
+
+	if *stackCommentFlag && (*planFlag || *dryRunFlag) {
+		printStackComments(base, allTips)
+	}
+	if *planFlag {
+		if *jsonFlag {
+			return printJSON(base, allTips, nil)
+		}
+		for _, h := range plannedHeads(tips) {
+			if err := printRefspec(h); err != nil {
+				return err
+			}
+		}
+		if len(plannedHeads(allTips)) == 0 {
+			return noBranchesError(base)
+		}
+		return nil
+	}
+
+	var prunes []head
+	stack := stackName()
+	var f forge
+	if *createMRsFlag {
+		f = gitlabForge{}
+	} else if *createPRsFlag || *retargetFlag || *stackCommentFlag {
+		f = detectForge(*remoteFlag)
+	}
+	needsBranch := *createPRsFlag || *createMRsFlag || *retargetFlag || *forgeFlag == "gitlab"
+	if needsBranch && !*dryRunFlag && isRevision(base) {
+		return fmt.Errorf("base %s is a tag or commit, but pull and merge requests need a branch to merge into", base)
+	}
+	if f != nil && !*dryRunFlag {
+		if err := f.checkAuth(); err != nil {
+			return err
+		}
+	}
+	if !*dryRunFlag {
+		remoteHeads, err = listRemoteHeads(*remoteFlag)
+		if err != nil {
+			return err
+		}
+		if pushedRefs, err = readPushedRefs(*remoteFlag); err != nil {
+			return err
+		}
+		if *pruneRemoteFlag {
+			if stack == "" && !*quietFlag {
+				fmt.Fprintf(os.Stderr, "Warning: %s is not a branch, --prune-remote only deletes branches pushed from a named stack\n", *headFlag)
+			}
+			prunes = pruneCandidates(base, stack, allTips)
+			if len(prunes) > 0 && !*yesFlag && !isTerminal(os.Stdout) {
+				return errors.New("--prune-remote deletes remote branches, pass --yes to confirm when not running in a terminal")
+			}
+		}
+		if !*yesFlag && isTerminal(os.Stdout) && !confirmPush(tips, prunes) {
+			return errors.New("aborted, nothing was pushed")
+		}
+	}
+
+	var results []pushResult
+	var stale []pushResult
+	for _, h := range excluded {
+		results = append(results, newResult(h, "exclude", nil))
+	}
+	if *dryRunFlag {
+		if dir := tagTemplateDir(); dir != "" && refExists("refs/tags/"+dir) {
+			return fmt.Errorf("tag %s is in the way of the %s/ tag namespace, delete it or pass --tag-template", dir, dir)
+		}
+		// Stale tags go first so that an old PR_BRANCH/a cannot block PR_BRANCH/a/b.
+		if stale, err = removeStaleTags(active, *dryDeleteFlag); err != nil {
+			return err
+		}
+		pushed := newPushedSet()
+		p := &progress{total: len(plannedHeads(tips))}
+		for _, t := range tips {
+			results = append(results, tagBranches(pushed, p, base, t)...)
+		}
+	} else {
+		var heads []head
+		for _, h := range pushOrder(tips) {
+			if !*forceAllFlag && remoteHeads[h.ref] == h.sha {
+				results = append(results, newResult(h, "skip", nil))
+				continue
+			}
+			heads = append(heads, h)
+		}
+		if *forgeFlag == "gitlab" {
+			mergeRequestTargets = requestBases(base, allTips)
+		}
+		if *atomicFlag {
+			results = append(results, pushAtomic(heads)...)
 		} else {
-			pushBranches(t)
+			results = append(results, pushBranches(heads, stackedOn(tips))...)
+		}
+		for _, h := range prunes {
+			results = append(results, pruneBranch(h))
+		}
+		if err := recordPushes(*remoteFlag, stack, results); err != nil {
+			return err
+		}
+		if *onPushFlag != "" {
+			results = append(results, runHooks(results)...)
+		}
+		if f != nil && *retargetFlag {
+			results = append(results, retargetRequests(f, base, allTips, results)...)
+		}
+		if f != nil && (*createPRsFlag || *createMRsFlag) {
+			results = append(results, createRequests(f, base, allTips, results)...)
+		}
+		if f != nil && *stackCommentFlag {
+			results = append(results, commentRequests(f, base, allTips)...)
+		}
+		if stale, err = removeStaleTags(active, *dryDeleteFlag); err != nil {
+			return err
 		}
 	}
 
-	removeStaleTags(active)
+	if *dryRunFlag && !*quietFlag {
+		if err := printDrySummary(results); err != nil {
+			return err
+		}
+	}
+	results = append(results, stale...)
+	if *jsonFlag {
+		if err := printJSON(base, allTips, results); err != nil {
+			return err
+		}
+	}
+	if detached {
+		fmt.Fprintf(out, "Ran from a detached HEAD at %s\n", shortSha(tip))
+	}
+	if !*dryRunFlag && !*quietFlag {
+		printBranchURLs(results)
+	}
+	if err := printSummary(results); err != nil {
+		return err
+	}
+	if len(plannedHeads(allTips)) == 0 {
+		return noBranchesError(base)
+	}
+	return nil
+}
+
+var actionPastTense = map[string]string{
+	"push":      "pushed",
+	"skip":      "up to date",
+	"tag":       "tagged",
+	"delete":    "deleted",
+	"hook":      "ran --on-push for",
+	"pr":        "opened PR for",
+	"pr-exists": "found open PR for",
+	"mr":        "opened MR for",
+	"mr-exists": "found open MR for",
+	"prune":     "deleted remote branch",
+	"exclude":   "skipped (excluded)",
+	"retarget":  "retargeted",
+	"comment":   "updated stack comment on",
+}
+
+var actionVerb = map[string]string{
+	"hook":    "run --on-push for",
+	"pr":      "open PR for",
+	"mr":      "open MR for",
+	"comment": "update stack comment on",
+}
+
+func printSummary(results []pushResult) error {
+	if len(results) == 0 {
+		fmt.Fprintln(out, "Nothing to do")
+		return nil
+	}
+
+	counts := make(map[string]int)
+	failed := 0
+	rows := [][]string{{"REF", "ACTION", "SHA", "MESSAGE"}}
+	var shown []pushResult
+	for _, r := range results {
+		action := actionPastTense[r.action]
+		if !r.success {
+			failed++
+			verb := actionVerb[r.action]
+			if verb == "" {
+				verb = r.action
+			}
+			action = "failed to " + verb
+		} else {
+			counts[r.action]++
+			if *quietFlag {
+				continue
+			}
+		}
+		rows = append(rows, []string{r.head.ref, action, resultShas(r), r.message})
+		shown = append(shown, r)
+	}
+	if len(shown) > 0 {
+		printTable(out, rows, func(row, col int) string {
+			if row == 0 || col == 2 {
+				return ""
+			}
+			return resultColor(out, shown[row-1])
+		})
+	}
+
+	var parts []string
+	for _, action := range []string{"push", "skip", "exclude", "tag", "delete", "prune"} {
+		if counts[action] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[action], actionPastTense[action]))
+		}
+	}
+	failures := fmt.Sprintf("%d failed", failed)
+	if failed > 0 {
+		failures = colorize(out, colorRed, failures)
+	}
+	parts = append(parts, failures)
+	fmt.Fprintln(out, strings.Join(parts, ", "))
+
+	if failed > 0 {
+		return exitCodeError{exitPushFailed, fmt.Errorf("%d of %d operations failed", failed, len(results))}
+	}
+	return nil
+}
+
+// resultShas shows where a pushed branch moved from and to.
+func resultShas(r pushResult) string {
+	if r.head.sha == "" {
+		return ""
+	}
+	if old := remoteHeads[r.head.ref]; r.action == "push" && old != "" && old != r.head.sha {
+		return shortSha(old) + "→" + shortSha(r.head.sha)
+	}
+	return shortSha(r.head.sha)
+}
+
+func printDrySummary(results []pushResult) error {
+	rows := [][]string{{"REF", "SHA", "SUBJECT"}}
+	for _, r := range results {
+		subject, err := getSubject(r.head.sha)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, []string{r.head.ref, shortSha(r.head.sha), subject})
+	}
+	printTable(out, rows, func(row, col int) string {
+		switch {
+		case row == 0 || col == 2:
+			return ""
+		case col == 1:
+			return colorYellow
+		}
+		return resultColor(out, results[row-1])
+	})
+	return nil
+}
+
+func printList(base string, tips [][]head) {
+	for _, h := range stackHeads(base, tips) {
+		line := h.ref
+		if *shaFlag {
+			line += " " + h.sha
+		}
+		if *verboseFlag {
+			line += " " + h.base
+		}
+		fmt.Println(line)
+	}
+}
+
+func printStack(base string, tips [][]head) error {
+	printed := newPushedSet()
+	for _, t := range tips {
+		var heads []head
+		for _, h := range t {
+			if !shouldIgnoreRef(h.ref) && !printed.contains(h) {
+				printed.add(h)
+				heads = append(heads, h)
+			}
+		}
+		if len(heads) == 0 {
+			continue
+		}
+		for i, h := range heads {
+			subject, err := getSubject(h.sha)
+			if err != nil {
+				return err
+			}
+			branch := ""
+			if i > 0 {
+				branch = strings.Repeat("   ", i-1) + "└─ "
+			}
+			fmt.Printf("%s%s (%s) %s %s\n", branch, h.ref, pluralize(len(h.commits), "commit"), shortSha(h.sha), subject)
+		}
+		fmt.Printf("%s└─ %s\n", strings.Repeat("   ", len(heads)-1), base)
+	}
+	return nil
+}
+
+func pluralize(n int, word string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, word)
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
+
+type stackedHead struct {
+	head
+	base string
+}
+
+func stackHeads(base string, tips [][]head) []stackedHead {
+	var heads []stackedHead
+	pushed := newPushedSet()
+	for _, t := range tips {
+		for i, h := range t {
+			if shouldIgnoreRef(h.ref) || pushed.contains(h) {
+				continue
+			}
+			pushed.add(h)
+			heads = append(heads, stackedHead{head: h, base: baseBelow(base, h, t[i+1:])})
+		}
+	}
+	return heads
+}
+
+func baseBelow(base string, h head, below []head) string {
+	if *parentBaseFlag {
+		return base
+	}
+	for _, b := range below {
+		if b.sha != h.sha && !shouldIgnoreRef(b.ref) {
+			return b.ref
+		}
+	}
+	return base
+}
+
+func shortSha(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
+
+func findBase() (string, error) {
+	if flag.NArg() > 1 {
+		return "", fmt.Errorf("expected at most one base argument, got %q", flag.Args())
+	}
+	base := *baseFlag
+	if flag.NArg() == 1 {
+		if base != "" && base != flag.Arg(0) {
+			return "", fmt.Errorf("base given both as --base %q and as argument %q", base, flag.Arg(0))
+		}
+		base = flag.Arg(0)
+	}
+	if base == "" {
+		base = findDefaultBranch(*remoteFlag)
+	}
+	if base == "" {
+		return "", fmt.Errorf("could not detect the default branch of %q, pass the base explicitly with --base", *remoteFlag)
+	}
+	if *baseRemoteFlag != "" && !strings.HasPrefix(base, *baseRemoteFlag+"/") && !isRevision(base) {
+		base = *baseRemoteFlag + "/" + base
+	}
+	if !refExists(base) {
+		return "", fmt.Errorf("base %q does not resolve to a commit, pass an existing branch, tag or commit with --base", base)
+	}
+	return base, nil
+}
+
+var shaPattern = regexp.MustCompile(`^[0-9a-f]{4,40}$`)
+
+// isRevision reports whether base names a tag or a commit rather than a
+// branch, which matters wherever the base has to exist on the remote.
+func isRevision(base string) bool {
+	if refExists("refs/tags/" + base) {
+		return true
+	}
+	if refExists("refs/heads/"+base) || refExists("refs/remotes/"+base) {
+		return false
+	}
+	return shaPattern.MatchString(base) && refExists(base)
 }
 
 type commit struct {
-	sha      string
-	message  string
-	psBranch string
-	isMerge  bool
+	sha        string
+	message    string
+	psBranches []string
+	isMerge    bool
 }
 
 type head struct {
-	sha string
-	ref string
+	sha     string
+	ref     string
+	commits []string
+	auto    bool
+	marker  string
 }
 
 type pushResult struct {
+	head    head
+	action  string
 	success bool
 	message string
 }
 
-func pushBranch(head head) {
-	cmd := exec.Command("git", "push", "--force", "origin",
-		fmt.Sprintf("%s:refs/heads/%s", head.sha, head.ref))
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+func newResult(head head, action string, err error) pushResult {
+	if err != nil {
+		return pushResult{head: head, action: action, message: err.Error()}
+	}
+	return pushResult{head: head, action: action, success: true}
+}
+
+func runEchoed(cmd *exec.Cmd, w io.Writer) error {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if *verboseFlag {
+		cmd.Stdout = w
+		fmt.Fprintln(w, cmd)
+	}
+
+	err := cmd.Run()
+	if *verboseFlag {
+		w.Write(stderr.Bytes())
+	}
+	if err != nil {
+		return errors.New(failureMessage(stderr.String(), err))
+	}
+	return nil
+}
+
+var remoteHeads map[string]string
+
+// pushedRefs is the record of what git-prpush pushed to the remote before
+// this run.
+var pushedRefs map[string]pushedRef
+
+func failureMessage(stderr string, err error) string {
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	for _, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "! [") {
+			return strings.TrimSpace(line)
+		}
+	}
+	if msg := strings.TrimSpace(lines[len(lines)-1]); msg != "" {
+		return msg
+	}
+	return err.Error()
+}
+
+func forceArg(head head) string {
+	if *forceFlag {
+		return "--force"
+	}
+	return fmt.Sprintf("--force-with-lease=refs/heads/%s:%s", remoteBranch(head.ref), leaseSha(head))
+}
+
+// leaseSha is the sha the remote branch must still be at for head to replace
+// it: what git-prpush last pushed there, or else what the remote-tracking
+// branch last saw. A remote branch that moved since then, say to a
+// teammate's commit, makes the push fail instead of dropping that commit. A
+// remote sha the new head already contains loses nothing and is leased as is.
+func leaseSha(head head) string {
+	current := remoteHeads[head.ref]
+	if current == "" {
+		return ""
+	}
+	if ok, err := backend.isAncestor(current, head.sha); err == nil && ok {
+		return current
+	}
+	if r, ok := pushedRefs[head.ref]; ok && r.sha != "" {
+		return r.sha
+	}
+	if sha, err := backend.resolve(fmt.Sprintf("refs/remotes/%s/%s", *remoteFlag, remoteBranch(head.ref))); err == nil {
+		return sha
+	}
+	return ""
+}
+
+func refspec(head head) string {
+	return fmt.Sprintf("%s:refs/heads/%s", head.sha, remoteBranch(head.ref))
+}
+
+// remoteBranch is the name a branch is pushed under. Everything else, from
+// remoteHeads to tags and state, uses the name from the trailer.
+func remoteBranch(ref string) string {
+	return *remotePrefixFlag + ref
+}
+
+// baseBranchName is the base as the forges and the remote know it, without
+// the remote in front of a remote-tracking base.
+func baseBranchName(base string) string {
+	for _, remote := range []string{*baseRemoteFlag, *remoteFlag} {
+		if remote != "" && strings.HasPrefix(base, remote+"/") {
+			return strings.TrimPrefix(base, remote+"/")
+		}
+	}
+	return base
+}
+
+func pushBranch(head head, w io.Writer) pushResult {
+	options := append([]string{forceArg(head)}, pushOptions(head)...)
+	attempts, err := pushWithRetries(options, []string{refspec(head)}, w)
+	if err != nil && strings.Contains(err.Error(), "stale info") {
+		if lease := leaseSha(head); lease != "" {
+			fmt.Fprintf(w, "Push of %s was rejected, the remote branch moved from %s to %s since it was last pushed or fetched (use --force to overwrite)\n", head.ref, shortSha(lease), shortSha(remoteHeads[head.ref]))
+		} else {
+			fmt.Fprintf(w, "Push of %s was rejected, the remote branch was never pushed or fetched here (use --force to overwrite)\n", head.ref)
+		}
+	}
+	return retriedResult(newResult(head, "push", err), attempts)
+}
+
+var transientPushErrors = []string{
+	"remote end hung up",
+	"early EOF",
+	"RPC failed",
+	"Could not resolve host",
+	"Connection timed out",
+	"Connection reset",
+	"Connection refused",
+	"Operation timed out",
+	"Failed to connect",
+	"HTTP 5",
+}
+
+func isTransientPushError(err error) bool {
+	msg := err.Error()
+	if strings.HasPrefix(msg, "! [") {
+		return false
+	}
+	for _, s := range transientPushErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func pushWithRetries(options, refspecs []string, w io.Writer) (int, error) {
+	delay := *retryDelayFlag
+	for attempt := 1; ; attempt++ {
+		err := backend.push(*remoteFlag, options, refspecs, w)
+		if err == nil || attempt > *retriesFlag || !isTransientPushError(err) {
+			return attempt, err
+		}
+		fmt.Fprintf(w, "Push failed: %s, retrying in %s (%d of %d)\n", err, delay, attempt, *retriesFlag)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func retriedResult(r pushResult, attempts int) pushResult {
+	if attempts <= 1 {
+		return r
+	}
+	if r.success {
+		r.message = fmt.Sprintf("succeeded after %d attempts", attempts)
+	} else {
+		r.message = fmt.Sprintf("%s (gave up after %d attempts)", r.message, attempts)
+	}
+	return r
+}
+
+var mergeRequestTargets map[pushedKey]string
 
-	fmt.Println(cmd)
-	_ = cmd.Run()
+func pushOptions(head head) []string {
+	target, ok := mergeRequestTargets[pushedKey{head.sha, head.ref}]
+	if !ok || remoteHeads[head.ref] == head.sha {
+		return nil
+	}
+	options := []string{"-o", "merge_request.create", "-o", "merge_request.target=" + target}
+	if *mrDraftFlag {
+		options = append(options, "-o", "merge_request.draft")
+	}
+	return options
 }
 
-func tagBranch(head head) {
-	cmd := exec.Command("git", "tag", "--force", tagName(head), head.sha)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+func runHooks(results []pushResult) []pushResult {
+	var hooks []pushResult
+	for _, r := range results {
+		if r.action != "push" || !r.success {
+			continue
+		}
+		command := strings.NewReplacer("{ref}", shellQuote(remoteBranch(r.head.ref)), "{sha}", r.head.sha).Replace(*onPushFlag)
+		hooks = append(hooks, newResult(r.head, "hook", runHook(command, out)))
+	}
+	return hooks
+}
 
-	fmt.Println(cmd)
-	_ = cmd.Run()
+// runHook streams the hook's output to w, keeping its stderr for the error.
+func runHook(command string, w io.Writer) error {
+	cmd := exec.Command("sh", "-c", command)
+	var stderr bytes.Buffer
+	w = &lockedWriter{w: w}
+	cmd.Stdout = w
+	cmd.Stderr = io.MultiWriter(w, &stderr)
+	if *verboseFlag {
+		fmt.Fprintln(w, cmd)
+	}
+	if err := cmd.Run(); err != nil {
+		return errors.New(failureMessage(stderr.String(), err))
+	}
+	return nil
 }
 
-func deleteTag(tag string) {
-	cmd := exec.Command("git", "tag", "--delete", tag)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// lockedWriter serializes writes so a command's stdout and stderr, copied by
+// separate goroutines, can share one writer.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
 
-	fmt.Println(cmd)
-	_ = cmd.Run()
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func pruneBranch(head head) pushResult {
+	lease := fmt.Sprintf("--force-with-lease=refs/heads/%s:%s", remoteBranch(head.ref), head.sha)
+	err := backend.push(*remoteFlag, []string{lease}, []string{":refs/heads/" + remoteBranch(head.ref)}, out)
+	return newResult(head, "prune", err)
+}
+
+func printRefspec(head head) error {
+	subject, err := getSubject(head.sha)
+	if err != nil {
+		return err
+	}
+	fmt.Println(colorHead(os.Stdout, head, fmt.Sprintf("%s\t%s", refspec(head), subject)))
+	return nil
+}
+
+const tagMarker = "Created by git-prpush"
+
+func tagBranch(head head, base string) pushResult {
+	name := tagName(head)
+	exists, managed, err := managedTag(name)
+	if err != nil {
+		return newResult(head, "tag", err)
+	}
+	if exists && !managed && !*forceTagsFlag {
+		return newResult(head, "tag", fmt.Errorf("tag %s was not created by git-prpush, use --force-tags to overwrite it", name))
+	}
+
+	message := ""
+	if !*lightweightFlag {
+		message = fmt.Sprintf("%s\n\nRef: %s\nCommit: %s\nBase: %s\nCommits: %d\nCreated: %s\nVersion: %s\n",
+			tagMarker, head.ref, head.sha, base, len(head.commits), time.Now().UTC().Format(time.RFC3339), version)
+	}
+	if err := backend.tag(name, head.sha, message, *signFlag, out); err != nil {
+		return newResult(head, "tag", err)
+	}
+	if message == "" {
+		return newResult(head, "tag", recordTag(name, head.sha))
+	}
+	return newResult(head, "tag", recordTag(name, ""))
+}
+
+func deleteTag(tag string) pushResult {
+	if err := backend.deleteTag(tag, out); err != nil {
+		return newResult(head{ref: tag}, "delete", err)
+	}
+	return newResult(head{ref: tag}, "delete", recordTag(tag, ""))
 }
 
 var BRANCH_PREFIX = "PR_BRANCH"
+var TAG_PREFIX = BRANCH_PREFIX
+
 func tagName(head head) string {
-  return fmt.Sprintf("%s/%s", BRANCH_PREFIX, head.ref)
+	return strings.NewReplacer("{ref}", head.ref, "{sha}", shortSha(head.sha)).Replace(*tagTemplateFlag)
+}
+
+func validateTagTemplate(template string) error {
+	if !strings.Contains(template, "{ref}") {
+		return fmt.Errorf("invalid tag template %q, it must contain {ref}", template)
+	}
+	name := tagName(head{ref: "example/branch", sha: "0123456789abcdef"})
+	if !validTagName(name) {
+		return fmt.Errorf("invalid tag template %q, %s is not a valid tag name", template, name)
+	}
+	return nil
+}
+
+// tagTemplateDir is the directory that every templated tag lives under, or
+// "" when the template starts with a placeholder.
+func tagTemplateDir() string {
+	literal := *tagTemplateFlag
+	if i := strings.Index(literal, "{"); i >= 0 {
+		literal = literal[:i]
+	}
+	if i := strings.LastIndex(literal, "/"); i >= 0 {
+		return literal[:i]
+	}
+	return ""
 }
 
+func tagTemplateRegexp() *regexp.Regexp {
+	pattern := regexp.QuoteMeta(*tagTemplateFlag)
+	pattern = strings.Replace(pattern, regexp.QuoteMeta("{ref}"), "(.+)", 1)
+	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta("{ref}"), ".+")
+	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta("{sha}"), "[0-9a-f]+")
+	return regexp.MustCompile("^" + pattern + "$")
+}
+
+var defaultIgnoredRefs = []string{"null", "nil"}
+
 func shouldIgnoreRef(ref string) bool {
-	ref = strings.ToLower(ref)
-	ignore := map[string]struct{}{
-		"":     {},
-		"null": {},
-		"nil":  {}}
-	_, ok := ignore[ref]
+	if ref == "" {
+		return true
+	}
+	ignored := strings.Split(*ignoreRefsFlag, ",")
+	if !*noDefaultIgnoresFlag {
+		ignored = append(ignored, defaultIgnoredRefs...)
+	}
+	for _, i := range ignored {
+		if strings.EqualFold(strings.TrimSpace(i), ref) {
+			return true
+		}
+	}
+	return false
+}
+
+type pushedKey struct {
+	sha string
+	ref string
+}
+
+type pushedSet struct {
+	mu    sync.Mutex
+	heads map[pushedKey]struct{}
+}
+
+func newPushedSet() *pushedSet {
+	return &pushedSet{heads: make(map[pushedKey]struct{})}
+}
+
+func (s *pushedSet) contains(h head) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.heads[pushedKey{h.sha, h.ref}]
 	return ok
 }
 
-var pushed map[string]struct{} = map[string]struct{}{}
+func (s *pushedSet) add(h head) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.heads[pushedKey{h.sha, h.ref}] = struct{}{}
+}
 
-func dfsPushes(heads []head, f func(h head)) {
+func dfsPushes(pushed *pushedSet, heads []head, f func(h head)) {
 	for _, h := range heads {
-		_, ok := pushed[h.sha]
-		if shouldIgnoreRef(h.ref) || ok {
+		if shouldIgnoreRef(h.ref) || pushed.contains(h) {
 			continue
 		}
 		f(h)
-		pushed[h.sha] = struct{}{}
+		pushed.add(h)
 	}
-
 }
 
-func removeStaleTags(active []string) {
-  m := make(map[string]struct{})
-  for _, t := range active {
-    m[t] = struct{}{}
-  }
-	tags := listTags()
+func removeStaleTags(active []string, preview bool) ([]pushResult, error) {
+	m := make(map[string]struct{})
+	for _, t := range active {
+		m[t] = struct{}{}
+	}
+	tags, err := backend.listTags(tagTemplateDir())
+	if err != nil {
+		return nil, err
+	}
+	matcher := tagTemplateRegexp()
+	var results []pushResult
 	for _, tag := range tags {
-    if !strings.HasPrefix(tag, BRANCH_PREFIX) {
-      continue
-    }
-    if _, ok := m[tag]; ok {
-      continue
-    }
+		if _, ok := m[tag]; ok || !matcher.MatchString(tag) {
+			continue
+		}
+
+		if _, managed, err := managedTag(tag); err != nil {
+			return nil, err
+		} else if !managed && !*forceTagsFlag {
+			continue
+		}
 
-    deleteTag(tag)
+		if preview {
+			sha, err := backend.resolve(tag)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(out, "Would delete tag %s (%s)\n", tag, sha)
+			continue
+		}
+		results = append(results, deleteTag(tag))
 	}
+	return results, nil
+}
+
+func tagBranches(pushed *pushedSet, p *progress, base string, heads []head) []pushResult {
+	var results []pushResult
+	dfsPushes(pushed, heads, func(head head) {
+		r := tagBranch(head, base)
+		p.report("tagging", r)
+		results = append(results, r)
+	})
+
+	return results
 }
 
-func listTags() []string {
-	var b bytes.Buffer
-	cmd := exec.Command("git", "tag", "--list")
-	cmd.Stdout = &b
-	cmd.Stderr = os.Stderr
+// pushOrder lists heads bottom-up so that the code host never sees a branch
+// before the branch it is stacked on. Paths keep their order, and a head
+// shared between paths comes after everything below it on any of them.
+func pushOrder(tips [][]head) []head {
+	below := stackedOn(tips)
+	byKey := make(map[pushedKey]head)
+	for _, t := range tips {
+		for _, h := range t {
+			byKey[pushedKey{h.sha, h.ref}] = h
+		}
+	}
 
-	if err := cmd.Run(); err != nil {
-		log.Fatalf("Error running get sha err: %v", err)
+	var heads []head
+	pushed := newPushedSet()
+	var visit func(h head)
+	visit = func(h head) {
+		if shouldIgnoreRef(h.ref) || pushed.contains(h) {
+			return
+		}
+		pushed.add(h)
+		for _, b := range below[pushedKey{h.sha, h.ref}] {
+			visit(byKey[b])
+		}
+		heads = append(heads, h)
 	}
+	for _, t := range tips {
+		for i := len(t) - 1; i >= 0; i-- {
+			visit(t[i])
+		}
+	}
+	return heads
+}
 
-	return strings.Split(strings.TrimSpace(b.String()), "\n")
+// stackedOn maps each head to the heads directly below it, one per path it
+// is on.
+func stackedOn(tips [][]head) map[pushedKey][]pushedKey {
+	below := make(map[pushedKey][]pushedKey)
+	for _, t := range tips {
+		var prev pushedKey
+		for i := len(t) - 1; i >= 0; i-- {
+			if shouldIgnoreRef(t[i].ref) {
+				continue
+			}
+			key := pushedKey{t[i].sha, t[i].ref}
+			if prev.ref != "" && prev != key {
+				below[key] = append(below[key], prev)
+			}
+			prev = key
+		}
+	}
+	return below
 }
 
-func tagBranches(heads []head) []string {
-	var tags []string
-	dfsPushes(heads, func(head head) {
-		tagBranch(head)
-		tags = append(tags, tagName(head))
-	})
+func plannedHeads(tips [][]head) []head {
+	var heads []head
+	pushed := newPushedSet()
+	for _, t := range tips {
+		dfsPushes(pushed, t, func(h head) {
+			heads = append(heads, h)
+		})
+	}
+	return heads
+}
+
+func confirmPush(tips [][]head, prunes []head) bool {
+	moving, unchanged := 0, 0
+	for _, h := range plannedHeads(tips) {
+		if remoteHeads[h.ref] == h.sha {
+			unchanged++
+			fmt.Fprintf(out, "  %s\n", colorize(out, colorDim, fmt.Sprintf("%s %s (unchanged)", remoteBranch(h.ref), h.sha)))
+			continue
+		}
+		moving++
+		fmt.Fprintf(out, "  %s\n", colorHead(out, h, fmt.Sprintf("%s -> %s", remoteBranch(h.ref), h.sha)))
+	}
+
+	for _, h := range prunes {
+		fmt.Fprintf(out, "  %s\n", colorize(out, colorRed, fmt.Sprintf("%s %s (delete)", remoteBranch(h.ref), h.sha)))
+	}
 
-  return tags
+	fmt.Fprintf(out, "%d branches will move, %d are unchanged, %d will be deleted. Push to %s? [y/N] ", moving, unchanged, len(prunes), *remoteFlag)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
 }
 
-func pushBranches(heads []head) {
-	dfsPushes(heads, pushBranch)
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
 }
 
+const maxArgsLength = 30000
+
+func pushAtomic(heads []head) []pushResult {
+	var batches [][]head
+	var batch []head
+	length := 0
+	for _, h := range heads {
+		n := len(forceArg(h)) + len(refspec(h)) + 2
+		if len(batch) > 0 && length+n > maxArgsLength {
+			batches = append(batches, batch)
+			batch, length = nil, 0
+		}
+		batch = append(batch, h)
+		length += n
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	if len(batches) > 1 {
+		fmt.Fprintf(os.Stderr, "Too many branches for a single push, pushing in %d batches that are each atomic on their own\n", len(batches))
+	}
+
+	var results []pushResult
+	p := &progress{total: len(heads)}
+	for _, batch := range batches {
+		options := []string{"--atomic"}
+		if *forceFlag {
+			options = append(options, "--force")
+		} else {
+			for _, h := range batch {
+				options = append(options, forceArg(h))
+			}
+		}
+		var refspecs []string
+		for _, h := range batch {
+			refspecs = append(refspecs, refspec(h))
+		}
+
+		attempts, err := pushWithRetries(options, refspecs, out)
+		for _, h := range batch {
+			r := retriedResult(newResult(h, "push", err), attempts)
+			p.report("pushing", r)
+			results = append(results, r)
+		}
+	}
+	return results
+}
+
+// progress numbers each branch as it finishes. Callers that work in
+// parallel must serialize calls to report.
+type progress struct {
+	done  int
+	total int
+}
+
+func (p *progress) report(verb string, r pushResult) {
+	p.done++
+	if *quietFlag {
+		return
+	}
+	status := colorize(out, colorGreen, "ok")
+	if !r.success {
+		status = colorize(out, colorRed, "failed")
+	}
+	fmt.Fprintf(out, "[%d/%d] %s %s (%s) ... %s\n", p.done, p.total, verb, r.head.ref, shortSha(r.head.sha), status)
+}
+
+// pushBranches pushes heads in the order given, which must be bottom-up.
+// With --max-parallel a head still waits for the pushes of the heads it is
+// stacked on, looking further down past any that are not being pushed.
+func pushBranches(heads []head, below map[pushedKey][]pushedKey) []pushResult {
+	results := make([]pushResult, len(heads))
+	index := make(map[pushedKey]int)
+	done := make([]chan struct{}, len(heads))
+	for i, h := range heads {
+		index[pushedKey{h.sha, h.ref}] = i
+		done[i] = make(chan struct{})
+	}
+	var waitBelow func(key pushedKey)
+	waitBelow = func(key pushedKey) {
+		for _, b := range below[key] {
+			if j, ok := index[b]; ok {
+				<-done[j]
+			} else {
+				waitBelow(b)
+			}
+		}
+	}
+
+	jobs := make(chan int)
+	p := &progress{total: len(heads)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < *maxParallelFlag; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				waitBelow(pushedKey{heads[i].sha, heads[i].ref})
+				var b bytes.Buffer
+				results[i] = pushBranch(heads[i], &b)
+
+				mu.Lock()
+				out.Write(b.Bytes())
+				p.report("pushing", results[i])
+				mu.Unlock()
+				close(done[i])
+			}
+		}()
+	}
+
+	for i := range heads {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// findTipsOfPrs splits a path, newest commit first, into segments that each
+// end at a stopper: a commit with a branch trailer, or a merge. A segment
+// ending at a trailer becomes one head per branch named, with the newest
+// commit of the segment as its tip. A merge ends the segment above it but
+// pushes nothing, even if the merge has a trailer of its own, unless
+// --include-merges is set, which pushes a merge with a trailer like any other
+// marked commit. --auto-name instead names stoppers that have no trailer.
 func findTipsOfPrs(commits []commit) []head {
 	var stoppers []int
 	for i, commit := range commits {
-		if commit.psBranch != "" || commit.isMerge {
+		if len(commit.psBranches) > 0 || commit.isMerge {
 			stoppers = append(stoppers, i)
 		}
 	}
 
+	if len(stoppers) == 0 && *autoNameFlag && len(commits) > 0 {
+		stoppers = append(stoppers, len(commits)-1)
+	}
 	if len(stoppers) == 0 {
 		return nil
 	}
@@ -162,111 +1384,383 @@ func findTipsOfPrs(commits []commit) []head {
 	var tips []head
 	last := 0
 	for i := 0; i < len(stoppers); i++ {
-		if !commits[stoppers[i]].isMerge && commits[stoppers[i]].psBranch != "" {
-			tips = append(tips, head{
-				sha: commits[last].sha,
-				ref: commits[stoppers[i]].psBranch,
-			})
+		stopper := commits[stoppers[i]]
+		refs, auto := stopper.psBranches, false
+		if len(refs) == 0 && *autoNameFlag {
+			refs, auto = []string{autoBranchName(stopper)}, true
+		}
+		if !stopper.isMerge || auto || *includeMergesFlag {
+			end := stoppers[i] + 1
+			if i == len(stoppers)-1 {
+				end = len(commits)
+			}
+			var shas []string
+			for _, c := range commits[last:end] {
+				shas = append(shas, c.sha)
+			}
+			for _, ref := range refs {
+				tips = append(tips, head{
+					sha:     commits[last].sha,
+					ref:     ref,
+					commits: shas,
+					auto:    auto,
+					marker:  stopper.sha,
+				})
+			}
 		}
 		last = stoppers[i] + 1
 	}
 	return tips
 }
 
-func findBranchTags(commits []commit) []commit {
-	for i, commit := range commits {
-		commits[i].psBranch = findBranchTag(commit.message)
+var autoNameUser string
+
+func autoBranchName(c commit) string {
+	if autoNameUser == "" {
+		if autoNameUser = slugify(gitConfigValue("user.name")); autoNameUser == "" {
+			autoNameUser = "prpush"
+		}
 	}
-	return commits
+	key := shortSha(c.sha)
+	for _, t := range trailers(c.message) {
+		if trailerKey(t.key) == "change-id" && len(t.value) >= 8 {
+			key = strings.ToLower(t.value[:8])
+		}
+	}
+	subject := strings.SplitN(strings.TrimSpace(c.message), "\n", 2)[0]
+	if slug := slugify(subject); slug != "" {
+		return fmt.Sprintf("%s/%s-%s", autoNameUser, slug, key)
+	}
+	return fmt.Sprintf("%s/%s", autoNameUser, key)
 }
 
-func findBranchTag(message string) string {
-	message = strings.TrimSpace(message)
-	lines := strings.Split(message, "\n")
-	for _, line := range lines {
-		if strings.HasPrefix(line, BRANCH_PREFIX + "=") {
-			return strings.TrimPrefix(line, BRANCH_PREFIX + "=")
+func slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+			if b.Len() >= 40 {
+				break
+			}
+			continue
 		}
+		dash = true
 	}
-	return ""
+	return b.String()
 }
 
-func traversePaths(source, target string, path *[]commit, paths *[][]commit) {
-	if source == target {
-		c := make([]commit, len(*path))
-		copy(c, *path)
-		*paths = append(*paths, c)
-		return
+func validateBranchNames(paths [][]commit, tips [][]head) ([][]head, error) {
+	invalid := make(map[string]struct{})
+	var problems []string
+	for _, p := range paths {
+		for _, c := range p {
+			for _, ref := range c.psBranches {
+				if shouldIgnoreRef(ref) || validBranchName(ref) {
+					continue
+				}
+				invalid[ref] = struct{}{}
+				problems = append(problems, fmt.Sprintf("commit %s has invalid branch name %s=%s", shortSha(c.sha), BRANCH_PREFIX, ref))
+			}
+		}
+	}
+	refs := make(map[string]struct{})
+	for _, t := range tips {
+		for _, h := range t {
+			refs[h.ref] = struct{}{}
+		}
+	}
+	for ref := range refs {
+		for parent := path.Dir(ref); parent != "."; parent = path.Dir(parent) {
+			if _, ok := refs[parent]; ok {
+				invalid[ref] = struct{}{}
+				problems = append(problems, fmt.Sprintf("branch %s conflicts with branch %s, git cannot store a branch under another branch's name", ref, parent))
+				break
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return tips, nil
+	}
+	sort.Strings(problems)
+	if !*skipInvalidFlag {
+		return nil, fmt.Errorf("%s\nfix the commit messages or pass --skip-invalid to skip these branches", strings.Join(problems, "\n"))
 	}
 
-	parents := getParents(source)
-
-	*path = append(*path, makeCommit(source))
+	for _, p := range problems {
+		fmt.Fprintf(os.Stderr, "Skipping: %s\n", p)
+	}
+	var valid [][]head
+	for _, t := range tips {
+		var heads []head
+		for _, h := range t {
+			if _, ok := invalid[h.ref]; !ok {
+				heads = append(heads, h)
+			}
+		}
+		valid = append(valid, heads)
+	}
+	return valid, nil
+}
 
-	for _, p := range parents {
-		traversePaths(p, target, path, paths)
+// checkSelfReferences rejects trailers naming the base the stack sits on, and
+// trailers naming the checked out branch anywhere but at its own tip, since
+// pushing either would move a branch that is not a PR branch.
+func checkSelfReferences(base, tip string, tips [][]head) error {
+	baseName := baseBranchName(base)
+	current := currentBranch()
+	for _, h := range plannedHeads(tips) {
+		var problem string
+		switch {
+		case h.ref == base || h.ref == baseName:
+			problem = "the base the stack sits on"
+		case h.ref == current && h.sha != tip:
+			problem = fmt.Sprintf("the checked out branch, whose tip %s is above it", shortSha(tip))
+		default:
+			continue
+		}
+		subject, err := getSubject(h.marker)
+		if err != nil {
+			return err
+		}
+		suggestion := slugify(subject)
+		if suggestion == "" {
+			suggestion = baseName + "-" + shortSha(h.marker)
+		}
+		return fmt.Errorf("commit %s has %s=%s, which is %s, did you mean %s=%s?", shortSha(h.marker), BRANCH_PREFIX, h.ref, problem, BRANCH_PREFIX, suggestion)
 	}
+	return nil
+}
 
-	*path = (*path)[:len(*path)-1]
+func warnDuplicateTips(tips [][]head) {
+	seen := make(map[string]head)
+	for _, h := range plannedHeads(tips) {
+		other, ok := seen[h.sha]
+		if !ok {
+			seen[h.sha] = h
+			continue
+		}
+		// Several trailers on one commit name aliases on purpose.
+		if strings.Join(other.commits, " ") == strings.Join(h.commits, " ") {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "Warning: %s and %s both point at %s, pushing both creates two branches at the same commit\n", other.ref, h.ref, shortSha(h.sha))
+	}
 }
 
-func makeCommit(sha string) commit {
-	return commit{
-		sha:      sha,
-		psBranch: findBranchTag(getMessage(sha)),
-		isMerge:  len(getParents(sha)) > 1,
+func excludeHeads(tips [][]head) ([][]head, []head) {
+	if len(excludeFlag) == 0 {
+		return tips, nil
 	}
+	var kept [][]head
+	var excluded []head
+	pushed := newPushedSet()
+	for _, t := range tips {
+		var heads []head
+		for _, h := range t {
+			if !matchesAny(excludeFlag, h.ref) {
+				heads = append(heads, h)
+				continue
+			}
+			if !shouldIgnoreRef(h.ref) && !pushed.contains(h) {
+				pushed.add(h)
+				excluded = append(excluded, h)
+			}
+		}
+		kept = append(kept, heads)
+	}
+	return kept, excluded
 }
 
-func findCommitPaths(branch string) [][]commit {
-	var path []commit
-	var paths [][]commit
+func onlyHeads(tips [][]head) [][]head {
+	var kept [][]head
+	for _, t := range tips {
+		var heads []head
+		for _, h := range t {
+			if matchesAny(onlyFlag, h.ref) {
+				heads = append(heads, h)
+			}
+		}
+		kept = append(kept, heads)
+	}
+	return kept
+}
 
-	source := getSha("HEAD")
-	target := getSha(branch)
+func unmatchedPatterns(patterns []string, heads []head) []string {
+	var missing []string
+	for _, p := range patterns {
+		found := false
+		for _, h := range heads {
+			if matchesAny([]string{p}, h.ref) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
 
-	traversePaths(source, target, &path, &paths)
-	return paths
+func matchesAny(patterns []string, ref string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, ref); ok {
+			return true
+		}
+	}
+	return false
 }
 
-func getParents(ref string) []string {
-	var b bytes.Buffer
-	cmd := exec.Command("git", "show", "--no-patch", "--format=%P", ref)
-	cmd.Stdout = &b
-	cmd.Stderr = os.Stderr
+func findBranchTags(commits []commit) []commit {
+	for i, commit := range commits {
+		commits[i].psBranches = findBranchTag(commit.message)
+	}
+	return commits
+}
 
-	if err := cmd.Run(); err != nil {
-		log.Fatalf("Error running get parents err: %v", err)
+func findBranchTag(message string) []string {
+	var refs []string
+	var changeID string
+	seen := make(map[string]struct{})
+	for _, t := range trailers(message) {
+		if trailerKey(t.key) == "change-id" && changeID == "" {
+			changeID = t.value
+		}
+		if !isBranchTrailer(t.key) {
+			continue
+		}
+		if _, ok := seen[t.value]; ok || t.value == "" {
+			continue
+		}
+		seen[t.value] = struct{}{}
+		refs = append(refs, t.value)
+	}
+	if len(refs) == 0 && *fromChangeIDFlag && changeID != "" {
+		refs = append(refs, changeIDBranch(changeID))
 	}
+	return refs
+}
 
-	return strings.Split(strings.TrimSpace(b.String()), " ")
+func changeIDBranch(changeID string) string {
+	if len(changeID) > 10 {
+		changeID = changeID[:10]
+	}
+	return "changes/" + changeID
 }
 
-func getSha(ref string) string {
-	var b bytes.Buffer
-	cmd := exec.Command("git", "show", "--no-patch", "--format=%H", ref)
-	cmd.Stdout = &b
-	cmd.Stderr = os.Stderr
+func traversePaths(graph map[string]commitInfo, source, target string) [][]commit {
+	reaches := make(map[string]bool)
+	canReach := func(start string) bool {
+		if start == target {
+			return true
+		}
+		stack := []string{start}
+		for len(stack) > 0 {
+			sha := stack[len(stack)-1]
+			if _, ok := reaches[sha]; ok {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			pending := false
+			for _, p := range graph[sha].parents {
+				if _, ok := reaches[p]; !ok && p != target {
+					stack = append(stack, p)
+					pending = true
+				}
+			}
+			if pending {
+				continue
+			}
+			reaches[sha] = false
+			for _, p := range graph[sha].parents {
+				if p == target || reaches[p] {
+					reaches[sha] = true
+				}
+			}
+			stack = stack[:len(stack)-1]
+		}
+		return reaches[start]
+	}
 
-	if err := cmd.Run(); err != nil {
-		log.Fatalf("Error running get sha err: %v", err)
+	var paths [][]commit
+	started := make(map[string]struct{})
+	starts := []string{source}
+	for len(starts) > 0 {
+		start := starts[len(starts)-1]
+		starts = starts[:len(starts)-1]
+		if _, ok := started[start]; ok || !canReach(start) {
+			continue
+		}
+		started[start] = struct{}{}
+
+		var path []commit
+		for sha := start; sha != target; {
+			info := graph[sha]
+			path = append(path, makeCommit(sha, info))
+			if len(info.parents) > 1 {
+				for i := len(info.parents) - 1; i >= 0; i-- {
+					starts = append(starts, info.parents[i])
+				}
+				break
+			}
+			sha = info.parents[0]
+		}
+		paths = append(paths, path)
 	}
+	return paths
+}
 
-	return strings.TrimSpace(b.String())
+func makeCommit(sha string, info commitInfo) commit {
+	return commit{
+		sha:        sha,
+		message:    info.message,
+		psBranches: findBranchTag(info.message),
+		isMerge:    len(info.parents) > 1,
+	}
 }
 
+func findCommitPaths(backend gitBackend, source, branch string) ([][]commit, error) {
+	target, err := backend.resolve(branch)
+	if err != nil {
+		return nil, err
+	}
 
-func getMessage(sha string) string {
-	var b bytes.Buffer
-	cmd := exec.Command("git", "show", "--no-patch", "--format=%B", sha)
-	cmd.Stdout = &b
-	cmd.Stderr = os.Stderr
+	ok, err := backend.isAncestor(target, source)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, notAncestorError(branch)
+	}
 
-	if err := cmd.Run(); err != nil {
-		log.Fatalf("Error running get message %v", err)
-		log.Fatalf("Error running get message err: %v", err)
+	limit := 0
+	if *maxDepthFlag > 0 {
+		limit = *maxDepthFlag + 1
+	}
+	graph, err := backend.loadCommits(source, target, limit)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(graph) >= limit {
+		return nil, fmt.Errorf("base %s is more than %d commits below %s, check that you are on the right branch or raise --max-depth", branch, *maxDepthFlag, *headFlag)
 	}
 
-	return b.String()
+	paths := traversePaths(graph, source, target)
+	if len(paths) == 0 && source != target {
+		return nil, notAncestorError(branch)
+	}
+	return paths, nil
 }
 
+func notAncestorError(base string) error {
+	hint := fmt.Sprintf("run git fetch %s and compare against %s/%s, it may have been rewritten", *remoteFlag, *remoteFlag, base)
+	if strings.HasPrefix(base, *remoteFlag+"/") {
+		hint = fmt.Sprintf("run git fetch %s, then rebase onto %s or pass the base the stack was built on", *remoteFlag, base)
+	}
+	return fmt.Errorf("base %s is not an ancestor of %s, %s", base, *headFlag, hint)
+}
@@ -0,0 +1,716 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	f := flag.Lookup(name)
+	old := f.Value.String()
+	if err := f.Value.Set(value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Value.Set(old) })
+}
+
+func useBackend(t testing.TB, b gitBackend) {
+	old := backend
+	backend = b
+	t.Cleanup(func() { backend = old })
+}
+
+func subjects(paths [][]commit) [][]string {
+	var names [][]string
+	for _, p := range paths {
+		var path []string
+		for _, c := range p {
+			path = append(path, strings.SplitN(c.message, "\n", 2)[0])
+		}
+		names = append(names, path)
+	}
+	return names
+}
+
+func TestTraversePaths(t *testing.T) {
+	f := newFakeBackend()
+	base := f.commit("base", "base")
+	linear := f.chain(base, "a1", "a2\n\nPR_BRANCH=a", "b1\n\nPR_BRANCH=b")
+
+	left := f.chain(base, "left")
+	right := f.chain(base, "right")
+	merge := f.commit("merge", "merge", left[0], right[0])
+	top := f.chain(merge, "top\n\nPR_BRANCH=top")
+
+	root := f.commit("root", "root")
+	unrelated := f.chain(root, "unrelated\n\nPR_BRANCH=u")
+
+	for _, c := range []struct {
+		name   string
+		source string
+		want   [][]string
+	}{
+		{"linear", linear[2], [][]string{{"b1", "a2", "a1"}}},
+		{"diamond", top[0], [][]string{{"top", "merge"}, {"left"}, {"right"}}},
+		{"source is the target", base, [][]string{nil}},
+		{"history ends at a root before the target", unrelated[0], nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := subjects(traversePaths(f.commits, c.source, base)); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("traversePaths = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestTraversePathsLongLinearHistory(t *testing.T) {
+	f := newFakeBackend()
+	base := f.commit("base", "base")
+	messages := make([]string, 10000)
+	for i := range messages {
+		messages[i] = "commit"
+	}
+	shas := f.chain(base, messages...)
+
+	start := time.Now()
+	paths := traversePaths(f.commits, shas[len(shas)-1], base)
+	if len(paths) != 1 || len(paths[0]) != len(shas) {
+		t.Fatalf("traversePaths found %d paths, want one of %d commits", len(paths), len(shas))
+	}
+	if paths[0][0].sha != shas[len(shas)-1] || paths[0][len(shas)-1].sha != shas[0] {
+		t.Error("traversePaths did not list the path newest first")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("traversePaths took %s", elapsed)
+	}
+}
+
+func TestFindCommitPaths(t *testing.T) {
+	f := newFakeBackend()
+	base := f.commit("base", "base")
+	stack := f.chain(base, "a1\n\nPR_BRANCH=a", "b1\n\nPR_BRANCH=b")
+	other := f.chain(base, "other")
+	f.refs["main"] = base
+	f.refs["other"] = other[0]
+
+	paths, err := findCommitPaths(f, stack[1], "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := subjects(paths), [][]string{{"b1", "a1"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("findCommitPaths = %v, want %v", got, want)
+	}
+
+	if _, err := findCommitPaths(f, stack[1], "other"); err == nil || !strings.Contains(err.Error(), "is not an ancestor") {
+		t.Errorf("findCommitPaths onto an unrelated base err: %v, want not an ancestor", err)
+	}
+	if _, err := findCommitPaths(f, stack[1], "missing"); err == nil {
+		t.Error("findCommitPaths onto a missing base succeeded")
+	}
+
+	setFlag(t, "max-depth", "1")
+	if _, err := findCommitPaths(f, stack[1], "main"); err == nil || !strings.Contains(err.Error(), "more than 1 commits") {
+		t.Errorf("findCommitPaths past --max-depth err: %v", err)
+	}
+}
+
+func testCommits(messages ...string) []commit {
+	var commits []commit
+	for i, message := range messages {
+		commits = append(commits, makeCommit(fakeSha(message+string(rune('a'+i))), commitInfo{message: message, parents: []string{"p"}}))
+	}
+	return commits
+}
+
+type tipSummary struct {
+	ref     string
+	sha     string
+	commits int
+}
+
+func summarize(tips []head) []tipSummary {
+	var got []tipSummary
+	for _, h := range tips {
+		got = append(got, tipSummary{h.ref, h.sha, len(h.commits)})
+	}
+	return got
+}
+
+func TestFindTipsOfPrs(t *testing.T) {
+	stack := testCommits("c2\n\nPR_BRANCH=c", "c1", "b1\n\nPR_BRANCH=b", "a2", "a1\n\nPR_BRANCH=a", "below")
+	unmarked := testCommits("x2", "x1")
+	twoMarkers := testCommits("b\n\nPR_BRANCH=b\nPR_BRANCH=release", "a\n\nPR_BRANCH=a")
+	adjacent := testCommits("c\n\nPR_BRANCH=c", "b\n\nPR_BRANCH=b", "a\n\nPR_BRANCH=a", "below")
+
+	for _, c := range []struct {
+		name    string
+		commits []commit
+		want    []tipSummary
+	}{
+		{"no markers", unmarked, nil},
+		{"empty path", nil, nil},
+		{"stack", stack, []tipSummary{
+			{"c", stack[0].sha, 1},
+			{"b", stack[1].sha, 2},
+			{"a", stack[3].sha, 3},
+		}},
+		{"two markers on one commit", twoMarkers, []tipSummary{
+			{"b", twoMarkers[0].sha, 1},
+			{"release", twoMarkers[0].sha, 1},
+			{"a", twoMarkers[1].sha, 1},
+		}},
+		{"adjacent markers three deep", adjacent, []tipSummary{
+			{"c", adjacent[0].sha, 1},
+			{"b", adjacent[1].sha, 1},
+			{"a", adjacent[2].sha, 2},
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := summarize(findTipsOfPrs(c.commits)); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("findTipsOfPrs = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestPushOrder(t *testing.T) {
+	a := head{sha: fakeSha("a"), ref: "a"}
+	b := head{sha: fakeSha("b"), ref: "b"}
+	c := head{sha: fakeSha("c"), ref: "c"}
+	d := head{sha: fakeSha("d"), ref: "d"}
+	ignored := head{sha: fakeSha("n"), ref: "null"}
+
+	for _, tc := range []struct {
+		name string
+		tips [][]head
+		want []string
+	}{
+		{"one path", [][]head{{c, b, a}}, []string{"a", "b", "c"}},
+		{"two paths sharing the bottom", [][]head{{c, b, a}, {d, a}}, []string{"a", "b", "c", "d"}},
+		{"shared head listed low on the first path", [][]head{{c, a}, {d, c, b}}, []string{"a", "b", "c", "d"}},
+		{"ignored refs are left out", [][]head{{b, ignored, a}}, []string{"a", "b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, h := range pushOrder(tc.tips) {
+				got = append(got, h.ref)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("pushOrder = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTraversePathsManyDiamonds(t *testing.T) {
+	f := newFakeBackend()
+	base := f.commit("base", "base")
+	tip := base
+	const diamonds = 60
+	for i := 0; i < diamonds; i++ {
+		left := f.chain(tip, "left")
+		right := f.chain(tip, "right")
+		tip = f.commit(fmt.Sprintf("merge %d", i), "merge", left[0], right[0])
+	}
+
+	start := time.Now()
+	paths := traversePaths(f.commits, tip, base)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("traversePaths took %s", elapsed)
+	}
+	// Every merge is walked once from each side, so the paths grow linearly
+	// where enumerating them would give 2^60.
+	if want := 1 + 2*diamonds; len(paths) != want {
+		t.Errorf("traversePaths found %d paths, want %d", len(paths), want)
+	}
+}
+
+func TestTagNames(t *testing.T) {
+	setFlag(t, "tag-template", "PR_BRANCH/{ref}")
+	pattern := tagTemplateRegexp()
+	for _, ref := range []string{"feat", "tona/feature/login", "PR_BRANCH"} {
+		name := tagName(head{ref: ref, sha: fakeSha(ref)})
+		if want := "PR_BRANCH/" + ref; name != want {
+			t.Errorf("tagName(%s) = %s, want %s", ref, name, want)
+		}
+		if m := pattern.FindStringSubmatch(name); m == nil || m[1] != ref {
+			t.Errorf("%s does not map back to %s, got %v", name, ref, m)
+		}
+	}
+	for _, tag := range []string{"PR_BRANCHES-old", "PR_BRANCH", "PR_BRANCH/", "other/PR_BRANCH/feat"} {
+		if pattern.MatchString(tag) {
+			t.Errorf("%s looks like a git-prpush tag", tag)
+		}
+	}
+	if dir := tagTemplateDir(); dir != "PR_BRANCH" {
+		t.Errorf("tagTemplateDir() = %s, want PR_BRANCH", dir)
+	}
+}
+
+func TestValidateBranchNamesDirectoryConflicts(t *testing.T) {
+	setFlag(t, "skip-invalid", "false")
+	a := head{sha: fakeSha("a"), ref: "a"}
+	ab := head{sha: fakeSha("ab"), ref: "a/b"}
+	abc := head{sha: fakeSha("abc"), ref: "a/b/c"}
+	other := head{sha: fakeSha("ac"), ref: "ac/b"}
+
+	if _, err := validateBranchNames(nil, [][]head{{other, a}}); err != nil {
+		t.Errorf("ac/b and a reported as conflicting: %v", err)
+	}
+	_, err := validateBranchNames(nil, [][]head{{abc, ab, a}})
+	if err == nil || !strings.Contains(err.Error(), "branch a/b conflicts with branch a") || !strings.Contains(err.Error(), "branch a/b/c conflicts with branch a/b") {
+		t.Errorf("validateBranchNames err: %v, want a/b and a/b/c to conflict", err)
+	}
+
+	setFlag(t, "skip-invalid", "true")
+	tips, err := validateBranchNames(nil, [][]head{{abc, ab, a}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := summarize(tips[0]); !reflect.DeepEqual(got, []tipSummary{{"a", a.sha, 0}}) {
+		t.Errorf("--skip-invalid kept %v, want only a", got)
+	}
+}
+
+// runCommand runs the whole tool in the current repository and returns what
+// it printed to stdout and stderr, restoring the globals run sets up.
+func runCommand(t *testing.T, command string, flags map[string]string) (string, string, error) {
+	t.Helper()
+	for _, name := range []string{"trailer", "tag-prefix", "tag-template", "quiet", "verbose"} {
+		setFlag(t, name, flag.Lookup(name).Value.String())
+	}
+	for name, value := range flags {
+		setFlag(t, name, value)
+	}
+	useBackend(t, backend)
+	oldPrefix, oldTagPrefix, oldOut := BRANCH_PREFIX, TAG_PREFIX, out
+	oldStdout, oldStderr := os.Stdout, os.Stderr
+	t.Cleanup(func() {
+		BRANCH_PREFIX, TAG_PREFIX, out = oldPrefix, oldTagPrefix, oldOut
+		os.Stdout, os.Stderr = oldStdout, oldStderr
+	})
+
+	dir := t.TempDir()
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout, os.Stderr, out = stdout, stderr, stderr
+	err = run(command)
+	os.Stdout, os.Stderr, out = oldStdout, oldStderr, oldOut
+
+	o, _ := ioutil.ReadFile(stdout.Name())
+	e, _ := ioutil.ReadFile(stderr.Name())
+	return string(o), string(e), err
+}
+
+func TestPlanFromDetachedHead(t *testing.T) {
+	r := newStackRepo(t)
+	r.git("checkout", "-q", "--detach", r.b1)
+
+	stdout, stderr, err := runCommand(t, "", map[string]string{"plan": "true", "base": "main"})
+	if err != nil {
+		t.Fatalf("run err: %v\n%s", err, stderr)
+	}
+	if !strings.Contains(stderr, "Stack tip HEAD is "+shortSha(r.b1)+" b1") {
+		t.Errorf("stderr does not name the stack tip:\n%s", stderr)
+	}
+	if !strings.Contains(stderr, "HEAD is detached") {
+		t.Errorf("stderr does not warn about the detached HEAD:\n%s", stderr)
+	}
+	for _, want := range []string{r.b1 + ":refs/heads/feat/b", r.a2 + ":refs/heads/feat/a"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("plan does not contain %s:\n%s", want, stdout)
+		}
+	}
+}
+
+func TestPlanWithHeadOverride(t *testing.T) {
+	r := newStackRepo(t)
+	r.git("checkout", "-q", "--detach", r.init)
+
+	stdout, stderr, err := runCommand(t, "", map[string]string{"plan": "true", "base": "main", "head": "stack"})
+	if err != nil {
+		t.Fatalf("run err: %v\n%s", err, stderr)
+	}
+	if !strings.Contains(stderr, "Stack tip stack is "+shortSha(r.b1)+" b1") {
+		t.Errorf("stderr does not name the stack tip:\n%s", stderr)
+	}
+	if strings.Contains(stderr, "HEAD is detached") {
+		t.Errorf("--head still warns about the detached HEAD:\n%s", stderr)
+	}
+	if !strings.Contains(stdout, r.b1+":refs/heads/feat/b") {
+		t.Errorf("plan does not push feat/b from --head:\n%s", stdout)
+	}
+}
+
+func TestTraversePathsIsDeterministic(t *testing.T) {
+	f := newFakeBackend()
+	base := f.commit("base", "base")
+	tip := base
+	for i := 0; i < 5; i++ {
+		left := f.chain(tip, "left", fmt.Sprintf("left %d\n\nPR_BRANCH=l%d", i, i))
+		right := f.chain(tip, fmt.Sprintf("right %d\n\nPR_BRANCH=r%d", i, i))
+		tip = f.commit(fmt.Sprintf("merge %d", i), "merge", left[1], right[0])
+	}
+
+	want := subjects(traversePaths(f.commits, tip, base))
+	for i := 0; i < 20; i++ {
+		if got := subjects(traversePaths(f.commits, tip, base)); !reflect.DeepEqual(got, want) {
+			t.Fatalf("traversePaths gave %v, then %v", want, got)
+		}
+	}
+}
+
+func TestCrissCrossMergesKeepTheirHeads(t *testing.T) {
+	f := newFakeBackend()
+	base := f.commit("base", "base")
+	left, right := base, base
+	const rounds = 40
+	for i := 0; i < rounds; i++ {
+		l := f.chain(left, fmt.Sprintf("left %d\n\nPR_BRANCH=l%d", i, i))[0]
+		r := f.chain(right, fmt.Sprintf("right %d\n\nPR_BRANCH=r%d", i, i))[0]
+		left = f.commit(fmt.Sprintf("merge right into left %d", i), "merge", l, r)
+		right = f.commit(fmt.Sprintf("merge left into right %d", i), "merge", r, l)
+	}
+	top := f.chain(left, "top\n\nPR_BRANCH=top")[0]
+
+	start := time.Now()
+	var tips [][]head
+	for _, p := range traversePaths(f.commits, top, base) {
+		tips = append(tips, findTipsOfPrs(p))
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("traversal took %s", elapsed)
+	}
+
+	refs := make(map[string]int)
+	for _, h := range plannedHeads(tips) {
+		refs[h.ref]++
+	}
+	// Every marker is reached through some merge and planned exactly once.
+	if len(refs) != 2*rounds+1 {
+		t.Errorf("found %d refs, want %d: %v", len(refs), 2*rounds+1, refs)
+	}
+	for ref, n := range refs {
+		if n != 1 {
+			t.Errorf("%s planned %d times", ref, n)
+		}
+	}
+}
+
+func TestPushKeepsTagsOfPushedBranches(t *testing.T) {
+	r := newStackRepo(t)
+	r.git("tag", "--delete", "PR_BRANCH/feat/a", "PR_BRANCH/feat/b")
+	r.commit("gone\n\nPR_BRANCH=feat/gone")
+	if _, stderr, err := runCommand(t, "", map[string]string{"dry": "true", "base": "main"}); err != nil {
+		t.Fatalf("dry run err: %v\n%s", err, stderr)
+	}
+	r.git("reset", "-q", "--hard", "HEAD~1")
+	r.git("init", "-q", "--bare", filepath.Join(r.dir, "origin.git"))
+	r.git("remote", "add", "origin", filepath.Join(r.dir, "origin.git"))
+
+	_, stderr, err := runCommand(t, "", map[string]string{"dry": "false", "base": "main", "yes": "true"})
+	if err != nil {
+		t.Fatalf("push err: %v\n%s", err, stderr)
+	}
+	got := strings.Fields(r.git("tag", "--list", "PR_BRANCH/*"))
+	if want := []string{"PR_BRANCH/feat/a", "PR_BRANCH/feat/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tags after pushing = %v, want %v", got, want)
+	}
+	if remote := r.git("ls-remote", "--heads", "origin"); !strings.Contains(remote, "refs/heads/feat/a") || !strings.Contains(remote, "refs/heads/feat/b") {
+		t.Errorf("remote heads after pushing:\n%s\n%s", remote, stderr)
+	}
+}
+
+func TestValidateBranchNamesRejectsInvalidNames(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	setFlag(t, "skip-invalid", "false")
+	for _, name := range []string{"my branch", "a..b", "feat~1", "feat^", "x.lock", "feat:a", "ends/", "back\\slash"} {
+		commits := testCommits("subject\n\nPR_BRANCH=" + name)
+		tips := [][]head{findTipsOfPrs(commits)}
+		_, err := validateBranchNames([][]commit{commits}, tips)
+		want := fmt.Sprintf("commit %s has invalid branch name PR_BRANCH=%s", shortSha(commits[0].sha), name)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("validateBranchNames(%q) err: %v, want %q", name, err, want)
+		}
+	}
+
+	commits := testCommits("subject\n\nPR_BRANCH=feat/ok-1.2")
+	if _, err := validateBranchNames([][]commit{commits}, [][]head{findTipsOfPrs(commits)}); err != nil {
+		t.Errorf("validateBranchNames(feat/ok-1.2) err: %v", err)
+	}
+}
+
+func TestRemotePrefix(t *testing.T) {
+	setFlag(t, "remote-prefix", "users/alice/")
+	setFlag(t, "tag-template", "PR_BRANCH/{ref}")
+	setFlag(t, "remote", "origin")
+	f := newFakeBackend()
+	useBackend(t, f)
+	old, oldPushed := remoteHeads, pushedRefs
+	remoteHeads = map[string]string{"feature": fakeSha("old")}
+	pushedRefs = map[string]pushedRef{"feature": {sha: fakeSha("old")}}
+	t.Cleanup(func() { remoteHeads, pushedRefs = old, oldPushed })
+	h := head{sha: fakeSha("new"), ref: "feature"}
+
+	if got, want := refspec(h), h.sha+":refs/heads/users/alice/feature"; got != want {
+		t.Errorf("refspec = %s, want %s", got, want)
+	}
+	if got, want := forceArg(h), "--force-with-lease=refs/heads/users/alice/feature:"+fakeSha("old"); got != want {
+		t.Errorf("forceArg = %s, want %s", got, want)
+	}
+	if got, want := tagName(h), "PR_BRANCH/feature"; got != want {
+		t.Errorf("tagName = %s, want %s", got, want)
+	}
+
+	if r := pushBranch(h, ioutil.Discard); !r.success {
+		t.Fatalf("pushBranch failed: %s", r.message)
+	}
+	if want := []string{"push origin " + h.sha + ":refs/heads/users/alice/feature"}; !reflect.DeepEqual(f.log, want) {
+		t.Errorf("pushes = %v, want %v", f.log, want)
+	}
+}
+
+func TestListRemoteHeadsStripsTheRemotePrefix(t *testing.T) {
+	r := newTestRepo(t)
+	sha := r.git("rev-parse", "HEAD")
+	r.git("init", "-q", "--bare", filepath.Join(r.dir, "origin.git"))
+	r.git("remote", "add", "origin", filepath.Join(r.dir, "origin.git"))
+	r.git("push", "-q", "origin", "HEAD:refs/heads/users/alice/feature", "HEAD:refs/heads/users/bob/feature", "HEAD:refs/heads/main")
+	setFlag(t, "remote-prefix", "users/alice/")
+
+	heads, err := listRemoteHeads("origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"feature": sha}; !reflect.DeepEqual(heads, want) {
+		t.Errorf("listRemoteHeads = %v, want %v", heads, want)
+	}
+}
+
+func TestFindTipsOfPrsWithMerges(t *testing.T) {
+	newCommit := func(message string, parents ...string) commit {
+		return makeCommit(fakeSha(message), commitInfo{message: message, parents: parents})
+	}
+	b := newCommit("b1\n\nPR_BRANCH=b", "p")
+	plainMerge := newCommit("merge", "p", "q")
+	markedMerge := newCommit("merge\n\nPR_BRANCH=m", "p", "q")
+	aTop := newCommit("a2", "p")
+	a := newCommit("a1\n\nPR_BRANCH=a", "p")
+
+	for _, c := range []struct {
+		name          string
+		includeMerges string
+		commits       []commit
+		want          []tipSummary
+	}{
+		{"plain merge is a boundary", "false", []commit{b, plainMerge, aTop, a}, []tipSummary{
+			{"b", b.sha, 1},
+			{"a", aTop.sha, 2},
+		}},
+		{"plain merge stays a boundary with --include-merges", "true", []commit{b, plainMerge, aTop, a}, []tipSummary{
+			{"b", b.sha, 1},
+			{"a", aTop.sha, 2},
+		}},
+		{"marked merge is skipped", "false", []commit{b, markedMerge, aTop, a}, []tipSummary{
+			{"b", b.sha, 1},
+			{"a", aTop.sha, 2},
+		}},
+		{"marked merge is pushed with --include-merges", "true", []commit{b, markedMerge, aTop, a}, []tipSummary{
+			{"b", b.sha, 1},
+			{"m", markedMerge.sha, 1},
+			{"a", aTop.sha, 2},
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			setFlag(t, "include-merges", c.includeMerges)
+			if got := summarize(findTipsOfPrs(c.commits)); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("findTipsOfPrs = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestTagOrShaBase(t *testing.T) {
+	r := newStackRepo(t)
+	useBackend(t, newCachedBackend(execBackend{}))
+	for base, want := range map[string]bool{"v1": true, r.init: true, r.init[:8]: true, "main": false, "stack": false} {
+		if got := isRevision(base); got != want {
+			t.Errorf("isRevision(%s) = %v, want %v", base, got, want)
+		}
+	}
+
+	for _, base := range []string{"v1", r.init, r.init[:8]} {
+		t.Run(base, func(t *testing.T) {
+			stdout, stderr, err := runCommand(t, "", map[string]string{"plan": "true", "base": base, "base-remote": "origin"})
+			if err != nil {
+				t.Fatalf("run err: %v\n%s", err, stderr)
+			}
+			for _, want := range []string{r.b1 + ":refs/heads/feat/b", r.a2 + ":refs/heads/feat/a"} {
+				if !strings.Contains(stdout, want) {
+					t.Errorf("plan does not contain %s:\n%s", want, stdout)
+				}
+			}
+		})
+	}
+
+	r.git("remote", "add", "origin", r.dir)
+	_, _, err := runCommand(t, "", map[string]string{"plan": "false", "dry": "false", "base": "v1", "base-remote": "", "create-prs": "true"})
+	if err == nil || !strings.Contains(err.Error(), "base v1 is a tag or commit") {
+		t.Errorf("--create-prs onto a tag err: %v, want a tag or commit error", err)
+	}
+}
+
+func TestPushBranchesPushesBottomUp(t *testing.T) {
+	setFlag(t, "remote", "origin")
+	oldOut := out
+	out = ioutil.Discard
+	t.Cleanup(func() { out = oldOut })
+
+	a := head{sha: fakeSha("a"), ref: "a"}
+	b := head{sha: fakeSha("b"), ref: "b"}
+	c := head{sha: fakeSha("c"), ref: "c"}
+	d := head{sha: fakeSha("d"), ref: "d"}
+	e := head{sha: fakeSha("e"), ref: "e"}
+	// Two paths share a; the second one lists its heads top-down in an
+	// order that differs from the first.
+	tips := [][]head{{c, b, a}, {e, d, a}}
+	below := map[string][]string{"b": {"a"}, "c": {"b"}, "d": {"a"}, "e": {"d"}}
+
+	for _, parallel := range []string{"1", "4"} {
+		t.Run("max-parallel "+parallel, func(t *testing.T) {
+			setFlag(t, "max-parallel", parallel)
+			for i := 0; i < 5; i++ {
+				f := newFakeBackend()
+				f.pushDelay = time.Millisecond
+				useBackend(t, f)
+				for _, r := range pushBranches(pushOrder(tips), stackedOn(tips)) {
+					if !r.success {
+						t.Fatalf("push of %s failed: %s", r.head.ref, r.message)
+					}
+				}
+
+				position := make(map[string]int)
+				for i, entry := range f.log {
+					ref := entry[strings.LastIndex(entry, "/")+1:]
+					position[ref] = i
+				}
+				if len(position) != 5 {
+					t.Fatalf("pushes = %v, want each of a to e once", f.log)
+				}
+				for ref, refs := range below {
+					for _, b := range refs {
+						if position[b] > position[ref] {
+							t.Errorf("pushes = %v, %s went before %s below it", f.log, ref, b)
+						}
+					}
+				}
+				if parallel == "1" {
+					want := []string{"a", "b", "c", "d", "e"}
+					for i, ref := range want {
+						if position[ref] != i {
+							t.Errorf("pushes = %v, want %v", f.log, want)
+							break
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBaseBranchName(t *testing.T) {
+	setFlag(t, "remote", "origin")
+	setFlag(t, "base-remote", "upstream")
+	for base, want := range map[string]string{
+		"main":                 "main",
+		"origin/main":          "main",
+		"upstream/release/1.0": "release/1.0",
+		"upstream/origin/main": "origin/main",
+		"fork/main":            "fork/main",
+		"originals/main":       "originals/main",
+	} {
+		if got := baseBranchName(base); got != want {
+			t.Errorf("baseBranchName(%q) = %q, want %q", base, got, want)
+		}
+	}
+}
+
+func TestRunHookStreamsOutput(t *testing.T) {
+	var w strings.Builder
+	if err := runHook("echo out; echo err >&2", &w); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.String(); len(got) != len("out\nerr\n") || !strings.Contains(got, "out\n") || !strings.Contains(got, "err\n") {
+		t.Errorf("hook output = %q, want out and err", got)
+	}
+
+	w.Reset()
+	err := runHook("echo progress; echo broken >&2; exit 3", &w)
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("runHook err: %v, want the hook's stderr", err)
+	}
+	if got := w.String(); !strings.Contains(got, "progress\n") || !strings.Contains(got, "broken\n") {
+		t.Errorf("failing hook output = %q, want progress and broken", got)
+	}
+}
+
+func TestPushKeepsCommitsPushedFromAnotherClone(t *testing.T) {
+	r := newRemoteRepo(t)
+	push := func() error {
+		t.Helper()
+		_, _, err := runCommand(t, "", map[string]string{"base": "main", "yes": "true", "dry": "false"})
+		return err
+	}
+	r.git("checkout", "-q", "-b", "feat")
+	r.commit("a\n\nPR_BRANCH=a")
+	r.commit("b\n\nPR_BRANCH=b")
+	if err := push(); err != nil {
+		t.Fatal(err)
+	}
+
+	clone := filepath.Join(r.dir, "clone")
+	r.git("clone", "-q", "-b", "b", filepath.Join(r.dir, "origin.git"), clone)
+	r.git("-C", clone, "-c", "user.name=Teammate", "-c", "user.email=teammate@example.com", "commit", "-q", "--allow-empty", "-m", "teammate fix")
+	r.git("-C", clone, "push", "-q", "origin", "b")
+	teammate := r.git("-C", clone, "rev-parse", "HEAD")
+
+	r.git("commit", "-q", "--amend", "--allow-empty", "-m", "b amended\n\nPR_BRANCH=b")
+	_, stderr, err := runCommand(t, "", map[string]string{"base": "main", "yes": "true", "dry": "false"})
+	if err == nil {
+		t.Error("push over the teammate's commit succeeded, want it rejected")
+	}
+	if want := "Push of b was rejected, the remote branch moved from"; !strings.Contains(stderr, want) {
+		t.Errorf("stderr = %s, want %q", stderr, want)
+	}
+	r.git("fetch", "-q", "origin")
+	if err := push(); err == nil {
+		t.Error("push over the fetched teammate's commit succeeded, want it rejected")
+	}
+	if got := r.git("ls-remote", "origin", "refs/heads/b"); !strings.HasPrefix(got, teammate) {
+		t.Errorf("remote b = %s, want the teammate's %s", got, teammate)
+	}
+
+	// Building on top of the teammate's commit loses nothing.
+	r.git("reset", "-q", "--hard", teammate)
+	r.commit("b on top\n\nPR_BRANCH=b")
+	if err := push(); err != nil {
+		t.Errorf("push on top of the teammate's commit err: %v", err)
+	}
+}
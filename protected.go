@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+var protectedFlag stringsFlag
+var allowProtectedFlag = flag.Bool("allow-protected", false, "Push to protected branches after typing each branch name to confirm")
+
+func init() {
+	flag.Var(&protectedFlag, "protected", "Refuse to push to branches matching this glob, on top of main, master, release/* and the base, can be repeated")
+}
+
+var defaultProtected = []string{"main", "master", "release/*"}
+
+// protectedPatterns adds the base branch to the configured patterns, both as
+// given and without the remote in front of a remote-tracking base.
+func protectedPatterns(base string) []string {
+	patterns := append(append([]string{}, defaultProtected...), protectedFlag...)
+	return append(patterns, baseBranchName(base), base)
+}
+
+func protectedHeads(base string, tips [][]head) []head {
+	patterns := protectedPatterns(base)
+	var protected []head
+	for _, h := range plannedHeads(tips) {
+		if matchesAny(patterns, remoteBranch(h.ref)) {
+			protected = append(protected, h)
+		}
+	}
+	return protected
+}
+
+func checkProtected(base string, tips [][]head, pushing bool) error {
+	protected := protectedHeads(base, tips)
+	if len(protected) == 0 {
+		return nil
+	}
+	var names []string
+	for _, h := range protected {
+		names = append(names, remoteBranch(h.ref))
+	}
+	sort.Strings(names)
+	if !*allowProtectedFlag {
+		return fmt.Errorf("refusing to push to protected branches %s, fix the %s trailers or pass --allow-protected", strings.Join(names, ", "), BRANCH_PREFIX)
+	}
+	if !pushing {
+		return nil
+	}
+	if !isTerminal(os.Stdin) {
+		return errors.New("--allow-protected needs a terminal to confirm each protected branch")
+	}
+	reader := bufio.NewReader(os.Stdin)
+	for _, name := range names {
+		fmt.Fprintf(out, "Force-pushing to protected branch %s, type its name to continue: ", name)
+		answer, _ := reader.ReadString('\n')
+		if strings.TrimSpace(answer) != name {
+			return fmt.Errorf("aborted, %s was not confirmed and nothing was pushed", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestProtectedPatterns(t *testing.T) {
+	setFlag(t, "remote", "origin")
+	setFlag(t, "base-remote", "upstream")
+	old := protectedFlag
+	protectedFlag = stringsFlag{"prod", "hotfix/*"}
+	t.Cleanup(func() { protectedFlag = old })
+
+	for _, c := range []struct {
+		base string
+		ref  string
+		want bool
+	}{
+		{"develop", "main", true},
+		{"develop", "master", true},
+		{"develop", "release/1.0", true},
+		{"develop", "release/1.0/rc", false},
+		{"develop", "releases", false},
+		{"develop", "prod", true},
+		{"develop", "hotfix/login", true},
+		{"develop", "feat/a", false},
+		{"develop", "develop", true},
+		{"origin/develop", "develop", true},
+		{"upstream/develop", "develop", true},
+		{"origin/develop", "origin/develop", true},
+		{"v1.0", "v1.0", true},
+	} {
+		if got := matchesAny(protectedPatterns(c.base), c.ref); got != c.want {
+			t.Errorf("with base %s, %s protected = %v, want %v", c.base, c.ref, got, c.want)
+		}
+	}
+}
+
+func TestCheckProtected(t *testing.T) {
+	setFlag(t, "remote", "origin")
+	setFlag(t, "allow-protected", "false")
+	feat := head{sha: fakeSha("feat"), ref: "feat/a"}
+	main := head{sha: fakeSha("main"), ref: "main"}
+	release := head{sha: fakeSha("release"), ref: "release/2.0"}
+	develop := head{sha: fakeSha("develop"), ref: "develop"}
+
+	for _, c := range []struct {
+		name string
+		base string
+		tips [][]head
+		want string
+	}{
+		{"feature branches", "origin/main", [][]head{{feat}}, ""},
+		{"default branch", "origin/develop", [][]head{{feat, main}}, "refusing to push to protected branches main,"},
+		{"release glob", "origin/develop", [][]head{{release, feat}}, "refusing to push to protected branches release/2.0,"},
+		{"remote-tracking base", "origin/develop", [][]head{{develop}}, "refusing to push to protected branches develop,"},
+		{"several at once", "develop", [][]head{{develop, main}}, "refusing to push to protected branches develop, main,"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkProtected(c.base, c.tips, true)
+			if c.want == "" && err != nil || c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)) {
+				t.Errorf("checkProtected err: %v, want %q", err, c.want)
+			}
+		})
+	}
+
+	setFlag(t, "allow-protected", "true")
+	stdin, err := ioutil.TempFile(t.TempDir(), "stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStdin := os.Stdin
+	os.Stdin = stdin
+	t.Cleanup(func() { os.Stdin = oldStdin })
+	if err := checkProtected("origin/develop", [][]head{{main}}, false); err != nil {
+		t.Errorf("--allow-protected without pushing err: %v", err)
+	}
+	if err := checkProtected("origin/develop", [][]head{{main}}, true); err == nil || !strings.Contains(err.Error(), "needs a terminal") {
+		t.Errorf("--allow-protected without a terminal err: %v, want it to need a terminal", err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func statePath(remote string) (string, error) {
+	return gitPath("git-prpush/" + url.PathEscape(remote))
+}
+
+func gitPath(name string) (string, error) {
+	stdout, err := gitOutput("rev-parse", "--git-path", name)
+	if err != nil {
+		return "", fmt.Errorf("error finding git-prpush state err: %w", err)
+	}
+	return strings.TrimSpace(stdout), nil
+}
+
+// pushedRef is what git-prpush last pushed to a branch: the commit, which the
+// next push leases against, and the stack that pushed it, the only one
+// --prune-remote lets delete it.
+type pushedRef struct {
+	sha   string
+	stack string
+}
+
+// readPushedRefs returns the branches git-prpush has pushed to remote. Lines
+// are "ref sha stack"; records from older versions only have the ref and
+// belong to no stack.
+func readPushedRefs(remote string) (map[string]pushedRef, error) {
+	refs := make(map[string]pushedRef)
+	path, err := statePath(remote)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return refs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s err: %w", path, err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var r pushedRef
+		if len(fields) > 1 {
+			r.sha = fields[1]
+		}
+		if len(fields) > 2 {
+			r.stack = fields[2]
+		}
+		refs[fields[0]] = r
+	}
+	return refs, nil
+}
+
+func writePushedRefs(remote string, refs map[string]pushedRef) error {
+	path, err := statePath(remote)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for ref, r := range refs {
+		lines = append(lines, strings.TrimSpace(strings.Join([]string{ref, r.sha, r.stack}, " "))+"\n")
+	}
+	sort.Strings(lines)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error writing %s err: %w", path, err)
+	}
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "")), 0644); err != nil {
+		return fmt.Errorf("error writing %s err: %w", path, err)
+	}
+	return nil
+}
+
+// readTagRecord returns the lightweight tags git-prpush has created and the
+// commit each one points at. They carry no marker, so this is the only way to
+// tell them apart from tags made by hand.
+func readTagRecord() (map[string]string, error) {
+	tags := make(map[string]string)
+	path, err := gitPath("git-prpush-tags")
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return tags, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s err: %w", path, err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			tags[fields[0]] = fields[1]
+		}
+	}
+	return tags, nil
+}
+
+// recordTag remembers that tag was created on sha, or forgets it when sha is
+// empty.
+func recordTag(tag, sha string) error {
+	tags, err := readTagRecord()
+	if err != nil {
+		return err
+	}
+	if tags[tag] == sha {
+		return nil
+	}
+	if sha == "" {
+		delete(tags, tag)
+	} else {
+		tags[tag] = sha
+	}
+	path, err := gitPath("git-prpush-tags")
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for name, sha := range tags {
+		lines = append(lines, name+" "+sha+"\n")
+	}
+	sort.Strings(lines)
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "")), 0644); err != nil {
+		return fmt.Errorf("error writing %s err: %w", path, err)
+	}
+	return nil
+}
+
+// stackName names the stack being pushed after the branch --head points at,
+// so records from one stack never make another one prune. A detached head or
+// a bare commit has no name.
+func stackName() string {
+	stdout, err := gitOutput("rev-parse", "--symbolic-full-name", *headFlag)
+	if name := strings.TrimSpace(stdout); err == nil && strings.HasPrefix(name, "refs/") {
+		return name
+	}
+	return ""
+}
+
+// recordPushes remembers what was pushed, and what was found already pushed,
+// for stack.
+func recordPushes(remote, stack string, results []pushResult) error {
+	refs, err := readPushedRefs(remote)
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		if !r.success {
+			continue
+		}
+		switch r.action {
+		case "push", "skip":
+			refs[r.head.ref] = pushedRef{sha: r.head.sha, stack: stack}
+		case "prune":
+			delete(refs, r.head.ref)
+		}
+	}
+	return writePushedRefs(remote, refs)
+}
+
+// pruneCandidates returns the remote branches stack pushed earlier that are no
+// longer in its plan.
+func pruneCandidates(base, stack string, tips [][]head) []head {
+	if stack == "" {
+		return nil
+	}
+	planned := make(map[string]struct{})
+	for _, h := range plannedHeads(tips) {
+		planned[h.ref] = struct{}{}
+	}
+
+	var prunes []head
+	for ref, r := range pushedRefs {
+		sha, ok := remoteHeads[ref]
+		if _, active := planned[ref]; active || !ok || r.stack != stack {
+			continue
+		}
+		if ref == baseBranchName(base) {
+			continue
+		}
+		prunes = append(prunes, head{sha: sha, ref: ref})
+	}
+	sort.Slice(prunes, func(i, j int) bool { return prunes[i].ref < prunes[j].ref })
+	return prunes
+}
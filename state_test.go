@@ -0,0 +1,108 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestManagedTag(t *testing.T) {
+	r := newStackRepo(t)
+	setFlag(t, "tag-template", "PR_BRANCH/{ref}")
+	useBackend(t, newCachedBackend(execBackend{}))
+
+	r.git("tag", "--delete", "PR_BRANCH/feat/a")
+	r.git("tag", "-a", "-m", tagMarker+"\n\nRef: feat/a", "PR_BRANCH/feat/a", r.a2)
+	r.git("tag", "-a", "-m", "release notes", "PR_BRANCH/annotated", r.a2)
+	r.git("tag", "PR_BRANCH/old", r.a1)
+	r.git("tag", "PR_BRANCH/recorded", r.a1)
+	if err := recordTag("PR_BRANCH/recorded", r.a1); err != nil {
+		t.Fatal(err)
+	}
+	r.git("tag", "PR_BRANCH/moved", r.a1)
+	if err := recordTag("PR_BRANCH/moved", r.a2); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		tag             string
+		exists, managed bool
+	}{
+		{"PR_BRANCH/feat/a", true, true},
+		{"PR_BRANCH/annotated", true, false},
+		// Lightweight tags from before the record existed still sit on the
+		// tip of the branch they are named after.
+		{"PR_BRANCH/feat/b", true, true},
+		{"PR_BRANCH/old", true, false},
+		{"PR_BRANCH/recorded", true, true},
+		{"PR_BRANCH/moved", true, false},
+		{"PR_BRANCH/missing", false, false},
+	} {
+		exists, managed, err := managedTag(c.tag)
+		if err != nil || exists != c.exists || managed != c.managed {
+			t.Errorf("managedTag(%s) = %v, %v, %v, want %v, %v", c.tag, exists, managed, err, c.exists, c.managed)
+		}
+	}
+
+	if err := recordTag("PR_BRANCH/recorded", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, managed, _ := managedTag("PR_BRANCH/recorded"); managed {
+		t.Error("PR_BRANCH/recorded is still managed after it was forgotten")
+	}
+}
+
+func TestLightweightDryRunKeepsHandMadeTags(t *testing.T) {
+	r := newStackRepo(t)
+	r.git("tag", "--delete", "PR_BRANCH/feat/a")
+	r.git("tag", "PR_BRANCH/old", r.a1)
+
+	for _, lightweight := range []string{"true", "false", "true"} {
+		if _, stderr, err := runCommand(t, "", map[string]string{"dry": "true", "base": "main", "lightweight": lightweight}); err != nil {
+			t.Fatalf("dry run with --lightweight=%s err: %v\n%s", lightweight, err, stderr)
+		}
+	}
+	if got := r.git("tag", "--list", "PR_BRANCH/*"); got != "PR_BRANCH/feat/a\nPR_BRANCH/feat/b\nPR_BRANCH/old" {
+		t.Errorf("tags after dry runs:\n%s", got)
+	}
+}
+
+// newRemoteRepo is a test repository with an empty bare origin.
+func newRemoteRepo(t *testing.T) *testRepo {
+	r := newTestRepo(t)
+	remote := filepath.Join(r.dir, "origin.git")
+	r.git("init", "-q", "--bare", remote)
+	r.git("remote", "add", "origin", remote)
+	return r
+}
+
+func TestPruneRemoteOnlyDeletesBranchesOfTheSameStack(t *testing.T) {
+	r := newRemoteRepo(t)
+	push := func() {
+		t.Helper()
+		if _, stderr, err := runCommand(t, "", map[string]string{"base": "main", "yes": "true", "prune-remote": "true"}); err != nil {
+			t.Fatalf("push err: %v\n%s", err, stderr)
+		}
+	}
+	remoteBranches := func() string {
+		return r.git("for-each-ref", "--format=%(refname:short)", "refs/remotes/origin/")
+	}
+
+	r.git("checkout", "-q", "-b", "feat")
+	r.commit("a\n\nPR_BRANCH=a")
+	r.commit("b\n\nPR_BRANCH=b")
+	push()
+	r.git("checkout", "-q", "-b", "other", "main")
+	r.commit("c\n\nPR_BRANCH=c")
+	push()
+	if got, want := remoteBranches(), "origin/a\norigin/b\norigin/c"; got != want {
+		t.Errorf("remote branches after pushing an unrelated stack:\n%s\nwant:\n%s", got, want)
+	}
+
+	r.git("checkout", "-q", "feat")
+	r.git("reset", "-q", "--hard", "HEAD~1")
+	push()
+	r.git("fetch", "-q", "--prune", "origin")
+	if got, want := remoteBranches(), "origin/a\norigin/c"; got != want {
+		t.Errorf("remote branches after dropping b from its stack:\n%s\nwant:\n%s", got, want)
+	}
+}
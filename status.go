@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+func branchStatus(local, remote string) (string, error) {
+	if remote == "" {
+		return "missing", nil
+	}
+	if remote == local {
+		return "up to date", nil
+	}
+	if !refExists(remote) {
+		return "unknown (fetch to compare)", nil
+	}
+
+	ahead, err := backend.isAncestor(remote, local)
+	if err != nil {
+		return "", err
+	}
+	if ahead {
+		return "ahead", nil
+	}
+	behind, err := backend.isAncestor(local, remote)
+	if err != nil {
+		return "", err
+	}
+	if behind {
+		return "behind", nil
+	}
+	return "diverged", nil
+}
+
+func printStatus(tips [][]head) error {
+	var err error
+	remoteHeads, err = listRemoteHeads(*remoteFlag)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "REF\tLOCAL\tREMOTE\tSTATUS\tCOMMITS")
+	outOfSync := 0
+	for _, h := range plannedHeads(tips) {
+		remote := remoteHeads[h.ref]
+		status, err := branchStatus(h.sha, remote)
+		if err != nil {
+			return err
+		}
+		if status != "up to date" {
+			outOfSync++
+		}
+		remoteSha := shortSha(remote)
+		if remoteSha == "" {
+			remoteSha = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", h.ref, shortSha(h.sha), remoteSha, status, len(h.commits))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if outOfSync > 0 {
+		return fmt.Errorf("%d branches are not up to date on %s", outOfSync, *remoteFlag)
+	}
+	return nil
+}
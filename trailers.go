@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+)
+
+type trailer struct {
+	key   string
+	value string
+}
+
+var gitTrailerPrefixes = []string{"Signed-off-by: ", "(cherry picked from commit "}
+
+// trailers follows git interpret-trailers: only the last paragraph after the
+// subject counts, and only if it is all trailers or a quarter are and git added one.
+func trailers(message string) []trailer {
+	paragraphs := strings.Split(strings.TrimSpace(strings.ReplaceAll(message, "\r\n", "\n")), "\n\n")
+	if len(paragraphs) < 2 {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSpace(paragraphs[len(paragraphs)-1]), "\n")
+
+	var found []trailer
+	other, generated := 0, false
+	for _, line := range lines {
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		for _, prefix := range gitTrailerPrefixes {
+			if strings.HasPrefix(line, prefix) {
+				generated = true
+			}
+		}
+		t, ok := parseTrailer(line)
+		if !ok {
+			other++
+			continue
+		}
+		found = append(found, t)
+	}
+	if other > 0 && !(generated && len(found)*3 >= other) {
+		return nil
+	}
+	return found
+}
+
+func parseTrailer(line string) (trailer, bool) {
+	i := strings.IndexAny(line, ":=")
+	if i <= 0 {
+		return trailer{}, false
+	}
+	key := strings.TrimRight(line[:i], " \t")
+	for _, r := range key {
+		if !(r == '-' || r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return trailer{}, false
+		}
+	}
+	if line[i] == '=' && !isBranchTrailer(key) {
+		return trailer{}, false
+	}
+	return trailer{key: key, value: strings.TrimSpace(line[i+1:])}, true
+}
+
+func isBranchTrailer(key string) bool {
+	return trailerKey(key) == trailerKey(BRANCH_PREFIX)
+}
+
+// trailerKey ignores case like git does, so pr_branch= and PR-Branch: name the
+// same trailer; when several spellings appear every value is used in order.
+func trailerKey(key string) string {
+	return strings.ToLower(strings.ReplaceAll(key, "_", "-"))
+}
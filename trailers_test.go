@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTrailers(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		message string
+		want    []trailer
+	}{
+		{"subject only", "PR_BRANCH=feat", nil},
+		{"trailer block", "subject\n\nbody\n\nPR_BRANCH=feat\nReviewed-by: someone", []trailer{{"PR_BRANCH", "feat"}, {"Reviewed-by", "someone"}}},
+		{"crlf line endings", "subject\r\n\r\nPR-Branch: feat\r\n", []trailer{{"PR-Branch", "feat"}}},
+		{"last paragraph has prose", "subject\n\nPR_BRANCH=feat\n\nnot a trailer", nil},
+		{"continuation lines are skipped", "subject\n\nFixes: one\n  two\nPR_BRANCH=feat", []trailer{{"Fixes", "one"}, {"PR_BRANCH", "feat"}}},
+		{"equals only counts for the branch trailer", "subject\n\na=b", nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := trailers(c.message); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("trailers(%q) = %v, want %v", c.message, got, c.want)
+			}
+		})
+	}
+}
+
+func TestFindBranchTag(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		message string
+		want    []string
+	}{
+		{"no trailer", "subject\n\nbody", nil},
+		{"legacy form", "subject\n\nPR_BRANCH=feat/a", []string{"feat/a"}},
+		{"empty value", "subject\n\nPR_BRANCH=", nil},
+		{"two markers", "subject\n\nPR_BRANCH=release/1\nPR-Branch: feat/a", []string{"release/1", "feat/a"}},
+		{"duplicate markers", "subject\n\nPR_BRANCH=feat/a\nPR-Branch: feat/a\nPR_BRANCH=feat/b", []string{"feat/a", "feat/b"}},
+		{"surrounding whitespace", "subject\n\nPR_BRANCH=  feat/a \t", []string{"feat/a"}},
+		{"token inside a paragraph", "subject\n\nthe log said\nPR_BRANCH=feat/a\nand then failed", nil},
+		{"token in a quoted block above the trailers", "subject\n\n    PR_BRANCH=old\n\nPR_BRANCH=feat/a", []string{"feat/a"}},
+		{"token in the subject", "PR_BRANCH=feat/a is gone", nil},
+		{"trailer form", "subject\n\nPR-Branch: feat/a", []string{"feat/a"}},
+		{"lowercase trailer form", "subject\n\npr-branch: feat/a", []string{"feat/a"}},
+		{"underscore trailer form", "subject\n\nPR_BRANCH: feat/a", []string{"feat/a"}},
+		{"mixed with other trailers", "subject\n\nReviewed-by: someone\nPR-Branch: feat/a\nSigned-off-by: me", []string{"feat/a"}},
+		{"among prose after git added a trailer", "subject\n\nsome words\nPR-Branch: feat/a\nSigned-off-by: me\n(cherry picked from commit abc)", []string{"feat/a"}},
+		{"equals form for other keys is prose", "subject\n\nfoo=bar\nPR-Branch: feat/a", nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := findBranchTag(c.message); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("findBranchTag(%q) = %v, want %v", c.message, got, c.want)
+			}
+		})
+	}
+}
+
+func TestFindBranchTagFromChangeID(t *testing.T) {
+	const changeID = "Change-Id: I0123456789abcdef0123456789abcdef01234567"
+	message := "subject\n\nbody\n\n" + changeID
+	if got := findBranchTag(message); got != nil {
+		t.Errorf("findBranchTag without --from-change-id = %v, want nothing", got)
+	}
+
+	setFlag(t, "from-change-id", "true")
+	for _, c := range []struct {
+		name    string
+		message string
+		want    []string
+	}{
+		{"change id only", message, []string{"changes/I012345678"}},
+		{"same id after a rebase reword", "reworded subject\n\nnew body\n\n" + changeID, []string{"changes/I012345678"}},
+		{"explicit marker wins", "subject\n\n" + changeID + "\nPR_BRANCH=feat/a", []string{"feat/a"}},
+		{"short change id", "subject\n\nChange-Id: Iabc", []string{"changes/Iabc"}},
+		{"change id outside the trailers", "subject\n\n" + changeID + "\n\nmore prose", nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := findBranchTag(c.message); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("findBranchTag(%q) = %v, want %v", c.message, got, c.want)
+			}
+		})
+	}
+}